@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+)
+
+type contextKey int
+
+const (
+	requestIdContextKey contextKey = iota
+	jsonErrorsContextKey
+)
+
+var (
+	ErrFileClaimed = errors.New("file claimed")
+	ErrNotUploader = errors.New("not the uploader")
+)
+
+// An error sent to clients.
+// Requests to the v1 API get it as JSON, with a stable code and details about the fields that were invalid.
+type APIError struct {
+	Status  int               `json:"-"`
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+var (
+	invalidTokenError     = APIError{Status: http.StatusUnauthorized, Code: "invalid_token", Message: "Invalid or missing token"}
+	notFoundError         = APIError{Status: http.StatusNotFound, Code: "not_found", Message: "Not found"}
+	methodNotAllowedError = APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "Method not allowed"}
+	invalidFormError      = APIError{Status: http.StatusBadRequest, Code: "invalid_form", Message: "Invalid form"}
+	invalidBodyError      = APIError{Status: http.StatusBadRequest, Code: "invalid_body", Message: "Invalid body"}
+)
+
+// API errors for sentinel errors
+var sentinelAPIErrors = []struct {
+	err    error
+	apiErr APIError
+}{
+	{ErrUnsupportedFile, APIError{Status: http.StatusForbidden, Code: "unsupported_format", Message: "Unsupported file format"}},
+	{ErrFileBlocked, APIError{Status: http.StatusForbidden, Code: "file_blocked", Message: "File blocked"}},
+	{ErrFileTooLarge, APIError{Status: http.StatusRequestEntityTooLarge, Code: "too_large", Message: "File too large"}},
+	{ErrFileClaimed, APIError{Status: http.StatusConflict, Code: "file_claimed", Message: "File is claimed and can't be deleted"}},
+	{ErrNotUploader, APIError{Status: http.StatusForbidden, Code: "not_uploader", Message: "Only the uploader can delete this file"}},
+	{ErrInvalidVariant, APIError{Status: http.StatusBadRequest, Code: "invalid_variant", Message: "Invalid image variant"}},
+	{ErrPresignUnsupported, APIError{Status: http.StatusNotImplemented, Code: "unsupported", Message: "Direct uploads unsupported"}},
+	{ErrSlotSizeMismatch, APIError{Status: http.StatusBadRequest, Code: "size_mismatch", Message: "Uploaded file doesn't match the declared size"}},
+	{ErrTusOffsetMismatch, APIError{Status: http.StatusConflict, Code: "offset_mismatch", Message: "Upload offset mismatch"}},
+	{ErrTusUploadLocked, APIError{Status: http.StatusLocked, Code: "upload_locked", Message: "Upload locked"}},
+	{ErrTusUploadElsewhere, APIError{Status: http.StatusServiceUnavailable, Code: "upload_elsewhere", Message: "Upload is held by another instance, try again"}},
+}
+
+// An error with a field of the request, like a body field, query parameter or header.
+type FieldError struct {
+	Err    error // what kind of error it is, e.g. ErrInvalidVariant
+	Field  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Get an error with details about the invalid field.
+func (apiErr APIError) WithField(field, reason string) APIError {
+	apiErr.Fields = map[string]string{field: reason}
+	return apiErr
+}
+
+// Get an internal error with the message.
+func internalError(message string) APIError {
+	return APIError{Status: http.StatusInternalServerError, Code: "internal_error", Message: message}
+}
+
+// Get the API error for an error.
+// Unexpected errors are logged and sent as internal errors with the message.
+func toAPIError(err error, message string) APIError {
+	var apiErr APIError
+	var tooLargeErr *FileTooLargeError
+	var fieldErr *FieldError
+	if errors.As(err, &tooLargeErr) {
+		apiErr = APIError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    "too_large",
+			Message: fmt.Sprintf("File too large, the maximum size is %d MiB", tooLargeErr.MaxSize>>20),
+		}
+	} else {
+		apiErr = internalError(message)
+		for _, sentinel := range sentinelAPIErrors {
+			if errors.Is(err, sentinel.err) {
+				apiErr = sentinel.apiErr
+				break
+			}
+		}
+		if apiErr.Code == "internal_error" {
+			log.Println(err)
+			sentry.CaptureException(err)
+			return apiErr
+		}
+	}
+
+	if errors.As(err, &fieldErr) {
+		apiErr = apiErr.WithField(fieldErr.Field, fieldErr.Reason)
+	}
+
+	return apiErr
+}
+
+// Give each request an ID, sent back in the X-Request-Id header.
+// The ID from the X-Request-Id request header is used if there is one (e.g. from a load balancer).
+func requestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 128 {
+			id, _ = generateId()
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdContextKey, id)))
+	})
+}
+
+// Send errors as JSON for requests to the versioned API.
+func jsonErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jsonErrorsContextKey, true)))
+	})
+}
+
+func getRequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdContextKey).(string)
+	return id
+}
+
+// Send an error response.
+// Requests to the versioned API get a JSON error, the rest get the plain text message.
+func sendError(w http.ResponseWriter, r *http.Request, apiErr APIError) {
+	if jsonErrors, _ := r.Context().Value(jsonErrorsContextKey).(bool); !jsonErrors {
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+
+	encoded, err := json.Marshal(map[string]any{
+		"error":      apiErr,
+		"request_id": getRequestId(r),
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	w.Write(encoded)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// What a claimed file is attached to, e.g. a post or chat.
+type FileAttachment struct {
+	Type string `bson:"type" json:"type"`
+	Id   string `bson:"id" json:"id"`
+}
+
+// Claim files for a resource, so they don't get cleaned up.
+// Files have to be in the bucket, uploaded by the uploader and not attached to anything else.
+// Returns the IDs of the files that are now claimed by the resource.
+func ClaimFiles(bucket, uploader string, ids []string, attachment FileAttachment) ([]string, error) {
+	if _, err := db.Collection("files").UpdateMany(
+		context.TODO(),
+		bson.M{
+			"_id":         bson.M{"$in": ids},
+			"bucket":      bucket,
+			"uploaded_by": uploader,
+			"$or": bson.A{
+				bson.M{"claimed": false},
+				bson.M{"attached_to": attachment},
+			},
+		},
+		bson.M{"$set": bson.M{
+			"claimed":     true,
+			"attached_to": attachment,
+		}},
+	); err != nil {
+		return nil, err
+	}
+
+	return getAttachedFileIds(bucket, uploader, ids, attachment)
+}
+
+// Unclaim files from a resource, they'll get cleaned up like any other unclaimed file.
+// Returns the IDs of the files that were unclaimed.
+func UnclaimFiles(bucket, uploader string, ids []string, attachment FileAttachment) ([]string, error) {
+	unclaimedIds, err := getAttachedFileIds(bucket, uploader, ids, attachment)
+	if err != nil || len(unclaimedIds) == 0 {
+		return unclaimedIds, err
+	}
+
+	_, err = db.Collection("files").UpdateMany(
+		context.TODO(),
+		bson.M{
+			"_id":         bson.M{"$in": unclaimedIds},
+			"attached_to": attachment,
+		},
+		bson.M{
+			"$set":   bson.M{"claimed": false},
+			"$unset": bson.M{"attached_to": ""},
+		},
+	)
+	return unclaimedIds, err
+}
+
+func getAttachedFileIds(bucket, uploader string, ids []string, attachment FileAttachment) ([]string, error) {
+	values, err := db.Collection("files").Distinct(
+		context.TODO(),
+		"_id",
+		bson.M{
+			"_id":         bson.M{"$in": ids},
+			"bucket":      bucket,
+			"uploaded_by": uploader,
+			"attached_to": attachment,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	attachedIds := make([]string, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(string); ok {
+			attachedIds = append(attachedIds, id)
+		}
+	}
+	return attachedIds, nil
+}
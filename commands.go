@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Run an admin command, e.g. "migrate-region -from old -to new -bucket attachments".
+func runCommand(args []string) error {
+	switch args[0] {
+	case "migrate-region":
+		return migrateRegionCommand(args[1:])
+	case "gc":
+		return gcCommand(args[1:])
+	case "deletions":
+		return deletionsCommand()
+	default:
+		return fmt.Errorf("unknown command %s, available commands: migrate-region, gc, deletions", args[0])
+	}
+}
+
+func migrateRegionCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate-region", flag.ContinueOnError)
+	from := fs.String("from", "", "region to move objects out of")
+	to := fs.String("to", "", "region to move objects into")
+	bucket := fs.String("bucket", "", "only move objects in this bucket")
+	ids := fs.String("ids", "", "only move objects for these comma-separated file IDs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" || *to == "" {
+		return errors.New("-from and -to are required")
+	}
+	if *bucket == "" && *ids == "" {
+		return errors.New("-bucket or -ids is required")
+	}
+
+	var fileIds []string
+	if *ids != "" {
+		fileIds = strings.Split(*ids, ",")
+	}
+
+	return migrateRegion(*from, *to, *bucket, fileIds)
+}
+
+func gcCommand(args []string) error {
+	defaultGrace, err := gcGracePeriod()
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report orphaned objects, don't delete them")
+	grace := fs.Duration("grace", defaultGrace, "keep orphaned objects newer than this")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := collectGarbage(*grace, *dryRun, nil)
+	if *dryRun {
+		log.Printf("Found %d orphaned objects (%d bytes) out of %d\n", report.Orphaned, report.OrphanedBytes, report.Scanned)
+	} else {
+		log.Printf("Queued %d orphaned objects (%d bytes) out of %d for deletion\n", report.Orphaned, report.OrphanedBytes, report.Scanned)
+	}
+	return err
+}
+
+// List queued deletions that have failed.
+func deletionsCommand() error {
+	deletions, err := getFailedDeletions()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deletions {
+		stuck := ""
+		if d.Attempts >= stuckDeletionAttempts {
+			stuck = " (stuck)"
+		}
+		log.Printf(
+			"%s in %s region: %d attempts%s, next attempt at %s, last error: %s\n",
+			d.Target(),
+			d.Region,
+			d.Attempts,
+			stuck,
+			time.Unix(d.NextAttemptAt, 0).Format(time.RFC3339),
+			d.LastError,
+		)
+	}
+	log.Printf("%d failed deletions\n", len(deletions))
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deletions that have failed this many times are reported as stuck
+const stuckDeletionAttempts = 10
+
+// How long a worker has to process a deletion before another worker can pick it up
+const deletionLease = 5 * time.Minute
+
+// An object removal, or a removal of every object starting with a prefix.
+type ObjectDeletion struct {
+	Id            string `bson:"_id"` // region/bucket/key, with a trailing * for prefixes
+	Region        string `bson:"region"`
+	Bucket        string `bson:"bucket"`
+	Key           string `bson:"key"`
+	Prefix        bool   `bson:"prefix,omitempty"`
+	Attempts      int    `bson:"attempts"`
+	LastError     string `bson:"last_error,omitempty"`
+	CreatedAt     int64  `bson:"created_at"`
+	NextAttemptAt int64  `bson:"next_attempt_at"`
+}
+
+var deletionNotify = make(chan struct{}, 1)
+
+// Add an object removal to the persistent deletion queue.
+// Queueing an object that's already queued does nothing.
+func queueObjectDeletion(region, bucket, key string) error {
+	return queueDeletion(ObjectDeletion{Region: region, Bucket: bucket, Key: key})
+}
+
+// Add a removal of every object starting with a prefix to the persistent deletion queue.
+// The objects are listed when the deletion is processed, so it works for objects that aren't recorded anywhere.
+func queueObjectPrefixDeletion(region, bucket, prefix string) error {
+	return queueDeletion(ObjectDeletion{Region: region, Bucket: bucket, Key: prefix, Prefix: true})
+}
+
+func queueDeletion(d ObjectDeletion) error {
+	id := fmt.Sprint(d.Region, "/", d.Bucket, "/", d.Key)
+	if d.Prefix {
+		id += "*"
+	}
+	_, err := db.Collection("object_deletions").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id},
+		bson.M{"$setOnInsert": bson.M{
+			"region":          d.Region,
+			"bucket":          d.Bucket,
+			"key":             d.Key,
+			"prefix":          d.Prefix,
+			"attempts":        0,
+			"created_at":      time.Now().Unix(),
+			"next_attempt_at": time.Now().Unix(),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case deletionNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Process queued deletions.
+// Runs every 10 seconds, or straight away when something is queued.
+func deletionWorker() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		for {
+			processed, err := processNextDeletion()
+			if err != nil {
+				log.Println(err)
+				sentry.CaptureException(err)
+			}
+			if !processed {
+				break
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deletionNotify:
+		}
+	}
+}
+
+// Claim and process the next due deletion.
+// Returns whether there was one to process.
+func processNextDeletion() (bool, error) {
+	var d ObjectDeletion
+	err := db.Collection("object_deletions").FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"next_attempt_at": bson.M{"$lte": time.Now().Unix()}},
+		bson.M{"$set": bson.M{"next_attempt_at": time.Now().Add(deletionLease).Unix()}},
+		options.FindOneAndUpdate().SetSort(bson.M{"next_attempt_at": 1}),
+	).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if processErr := d.process(); processErr != nil {
+		d.Attempts++
+		if d.Attempts == stuckDeletionAttempts {
+			sentry.CaptureMessage(fmt.Sprintf("Deletion of %s in %s region is stuck: %s", d.Target(), d.Region, processErr))
+		}
+		if _, err := db.Collection("object_deletions").UpdateOne(
+			context.TODO(),
+			bson.M{"_id": d.Id},
+			bson.M{"$set": bson.M{
+				"attempts":        d.Attempts,
+				"last_error":      processErr.Error(),
+				"next_attempt_at": time.Now().Add(retryBackoff(d.Attempts)).Unix(),
+			}},
+		); err != nil {
+			return true, err
+		}
+		return true, nil
+	}
+
+	_, err = db.Collection("object_deletions").DeleteOne(
+		context.TODO(),
+		bson.M{"_id": d.Id},
+	)
+	return true, err
+}
+
+// Get how long to wait before retrying after a number of failed attempts.
+// Grows exponentially from 20 seconds, capped at an hour.
+func retryBackoff(attempts int) time.Duration {
+	if attempts >= 10 {
+		return time.Hour
+	}
+	return min(time.Duration(1<<attempts)*10*time.Second, time.Hour)
+}
+
+// Get the bucket and key being deleted, with a trailing * for prefixes.
+func (d *ObjectDeletion) Target() string {
+	if d.Prefix {
+		return fmt.Sprint(d.Bucket, "/", d.Key, "*")
+	}
+	return fmt.Sprint(d.Bucket, "/", d.Key)
+}
+
+func (d *ObjectDeletion) process() error {
+	store, ok := objectStores[d.Region]
+	if !ok {
+		return fmt.Errorf("unknown region %s", d.Region)
+	}
+
+	// The object may have been uploaded again since it was queued
+	hash, _, _ := strings.Cut(d.Key, "_")
+	inUse, err := isObjectInRegion(d.Region, d.Bucket, hash)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return nil
+	}
+
+	// Stop before the lease runs out, so another worker doesn't start on the same deletion
+	ctx, cancel := context.WithTimeout(context.Background(), deletionLease/2)
+	defer cancel()
+
+	if d.Prefix {
+		return store.ListObjects(ctx, d.Bucket, d.Key, func(info ObjectInfo) error {
+			if err := store.RemoveObject(ctx, d.Bucket, info.Key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+				return err
+			}
+			return nil
+		})
+	}
+	if err := store.RemoveObject(ctx, d.Bucket, d.Key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Get whether any file says its objects are stored in a region.
+func isObjectInRegion(region, bucket, hashHex string) (bool, error) {
+	opts := options.Count()
+	opts.SetLimit(1)
+	count, err := db.Collection("files").CountDocuments(
+		context.TODO(),
+		bson.M{
+			"hash":   hashHex,
+			"bucket": bucket,
+			"$or": bson.A{
+				bson.M{"upload_region": region},
+				bson.M{"regions": region},
+				bson.M{"thumbnail_regions": region},
+			},
+		},
+		opts,
+	)
+	return count > 0, err
+}
+
+// Get deletions that have failed at least once.
+func getFailedDeletions() ([]ObjectDeletion, error) {
+	cur, err := db.Collection("object_deletions").Find(
+		context.TODO(),
+		bson.M{"attempts": bson.M{"$gt": 0}},
+		options.Find().SetSort(bson.M{"attempts": -1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var deletions []ObjectDeletion
+	err = cur.All(context.TODO(), &deletions)
+	return deletions, err
+}
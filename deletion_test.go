@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	for _, test := range []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 20 * time.Second},
+		{2, 40 * time.Second},
+		{3, 80 * time.Second},
+		{8, 2560 * time.Second},
+		{9, time.Hour},
+		{10, time.Hour},
+		{100, time.Hour},
+	} {
+		if backoff := retryBackoff(test.attempts); backoff != test.expected {
+			t.Errorf("retryBackoff(%d) = %s, expected %s", test.attempts, backoff, test.expected)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// Free space isn't checked on other platforms.
+func diskFreeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
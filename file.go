@@ -2,18 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/getsentry/sentry-go"
-	"github.com/minio/minio-go/v7"
 	"github.com/vmihailenco/msgpack/v5"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -22,6 +27,7 @@ import (
 type File struct {
 	Id            string `bson:"_id" json:"id"`
 	Hash          string `bson:"hash" json:"-"`
+	ProcessedHash string `bson:"processed_hash,omitempty" json:"-"`
 	Bucket        string `bson:"bucket" json:"-"`
 	Mime          string `bson:"mime" json:"mime"`
 	ThumbnailMime string `bson:"thumbnail_mime,omitempty" json:"thumbnail_mime,omitempty"`
@@ -31,52 +37,130 @@ type File struct {
 	Width         int    `bson:"width,omitempty" json:"width,omitempty"`
 	Height        int    `bson:"height,omitempty" json:"height,omitempty"`
 
-	UploadRegion string `bson:"upload_region" json:"-"`
-	UploadedBy   string `bson:"uploaded_by" json:"-"`
-	UploadedAt   int64  `bson:"uploaded_at" json:"-"`
+	UploadRegion     string   `bson:"upload_region" json:"-"`
+	Regions          []string `bson:"regions,omitempty" json:"-"`
+	ThumbnailRegions []string `bson:"thumbnail_regions,omitempty" json:"-"`
+	UploadedBy       string   `bson:"uploaded_by" json:"-"`
+	UploadedAt       int64    `bson:"uploaded_at" json:"-"`
 
-	Claimed bool `bson:"claimed" json:"-"`
+	Claimed    bool            `bson:"claimed" json:"-"`
+	AttachedTo *FileAttachment `bson:"attached_to,omitempty" json:"-"`
+}
+
+// A file that has been streamed into the ingest directory and hashed, but not processed yet.
+type ReceivedFile struct {
+	Id   string
+	Dir  string
+	Hash string
+	Size int64
+}
+
+// Get the next "file" part of a multipart form, skipping any other fields.
+// Returns io.EOF once there are no more files.
+func nextFilePart(reader *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
 }
 
 func IngestMultipartFile(
 	bucket string,
-	file multipart.File,
-	fileHeader *multipart.FileHeader,
+	part *multipart.Part,
 	uploader *User,
+	region string,
 ) (*File, error) {
-	// Init vars
-	var f File
-	var wg sync.WaitGroup
-	var err error
-	var id, hashHex string
-	var info minio.UploadInfo
+	return IngestFile(bucket, part, part.FileName(), uploader, region)
+}
 
+func IngestFile(
+	bucket string,
+	file io.Reader,
+	filename string,
+	uploader *User,
+	region string,
+) (*File, error) {
+	rf, err := ReceiveFile(file, getMaxUploadSize(bucket))
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Remove()
+	return rf.Ingest(bucket, filename, uploader, region)
+}
+
+// Stream a file into its own directory in the ingest directory, hashing it on the way.
+// Returns a FileTooLargeError as soon as more than maxSize bytes have been read.
+func ReceiveFile(file io.Reader, maxSize int64) (*ReceivedFile, error) {
 	// Create file ID
-	id, err = generateId()
+	id, err := generateId()
 	if err != nil {
 		sentry.CaptureException(err)
 		return nil, err
 	}
 
 	// Create directory in ingest directory for temporary files
-	ingestDir := fmt.Sprint(os.Getenv("INGEST_DIR"), "/", id)
-	defer os.RemoveAll(ingestDir)
-	if err := os.Mkdir(ingestDir, 0700); err != nil {
+	rf := ReceivedFile{
+		Id:  id,
+		Dir: fmt.Sprint(os.Getenv("INGEST_DIR"), "/", id),
+	}
+	if err := os.Mkdir(rf.Dir, 0700); err != nil {
 		sentry.CaptureException(err)
 		return nil, err
 	}
 
-	// Save file
-	dst, err := os.Create(fmt.Sprint(ingestDir, "/original"))
+	// Save and hash file
+	dst, err := os.Create(fmt.Sprint(rf.Dir, "/original"))
 	if err != nil {
+		rf.Remove()
 		sentry.CaptureException(err)
 		return nil, err
 	}
 	defer dst.Close()
-	if _, err := io.Copy(dst, file); err != nil {
-		sentry.CaptureException(err)
+	hasher := sha256.New()
+	rf.Size, err = io.Copy(io.MultiWriter(dst, hasher), io.LimitReader(file, maxSize+1))
+	if err != nil {
+		rf.Remove()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, &FileTooLargeError{MaxSize: maxSize}
+		}
 		return nil, err
 	}
+	if rf.Size > maxSize {
+		rf.Remove()
+		return nil, &FileTooLargeError{MaxSize: maxSize}
+	}
+	rf.Hash = hex.EncodeToString(hasher.Sum(nil))
+
+	return &rf, nil
+}
+
+// Remove the received file's temporary files.
+func (rf *ReceivedFile) Remove() error {
+	return os.RemoveAll(rf.Dir)
+}
+
+// Process and store the received file.
+func (rf *ReceivedFile) Ingest(
+	bucket string,
+	filename string,
+	uploader *User,
+	region string,
+) (*File, error) {
+	// Init vars
+	var f File
+	var wg sync.WaitGroup
+	var err error
+	var info ObjectInfo
+	var out []byte
+	id := rf.Id
+	ingestDir := rf.Dir
+	hashHex := rf.Hash
 
 	// "Ultra HD"
 	if uploader.Flags&FlagUltraHDUploads != 0 {
@@ -94,20 +178,15 @@ func IngestMultipartFile(
 				fmt.Sprint(ingestDir, "/original.jpg"),
 			).Run()
 			os.Rename(fmt.Sprint(ingestDir, "/original.jpg"), fmt.Sprint(ingestDir, "/original"))
-		}
-	}
 
-	// Get file hash
-	var out []byte
-	out, err = exec.Command(
-		"sha256sum",
-		fmt.Sprint(ingestDir, "/original"),
-	).Output()
-	if err != nil {
-		sentry.CaptureException(err)
-		return nil, err
+			// Hash the modified file instead
+			hashHex, err = hashFile(fmt.Sprint(ingestDir, "/original"))
+			if err != nil {
+				sentry.CaptureException(err)
+				return nil, err
+			}
+		}
 	}
-	hashHex = strings.Fields(string(out))[0]
 
 	// Make sure file isn't blocked
 	if blocked, err := getBlockStatus(hashHex); blocked || err != nil {
@@ -130,18 +209,20 @@ func IngestMultipartFile(
 	// Process and save file
 	if f.Hash == hashHex {
 		f.Id = id
-		f.Filename = cleanFilename(fileHeader.Filename)
+		f.Filename = cleanFilename(filename)
 		f.UploadedBy = uploader.Username
 		f.UploadedAt = time.Now().Unix()
 		f.Claimed = false
+		f.AttachedTo = nil
 	} else {
 		// Create file details
 		f = File{
 			Id:           id,
 			Hash:         hashHex,
 			Bucket:       bucket,
-			Filename:     cleanFilename(fileHeader.Filename),
-			UploadRegion: s3RegionOrder[0],
+			Filename:     cleanFilename(filename),
+			UploadRegion: region,
+			Regions:      []string{region},
 			UploadedBy:   uploader.Username,
 			UploadedAt:   time.Now().Unix(),
 		}
@@ -237,18 +318,23 @@ func IngestMultipartFile(
 				return nil, err
 			}
 
+			// Get hash of the processed file, since that's what gets stored
+			f.ProcessedHash, err = hashFile(fmt.Sprint(ingestDir, "/.", format))
+			if err != nil {
+				sentry.CaptureException(err)
+				return nil, err
+			}
+
 			// Upload to bucket
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				info, err = s3Clients[s3RegionOrder[0]].FPutObject(
+				info, err = objectStores[f.UploadRegion].PutFile(
 					ctx,
 					bucket,
 					hashHex,
 					fmt.Sprint(ingestDir, "/.", format),
-					minio.PutObjectOptions{
-						ContentType: fmt.Sprint("image/", format),
-					},
+					fmt.Sprint("image/", format),
 				)
 				f.Size = info.Size
 			}()
@@ -287,18 +373,23 @@ func IngestMultipartFile(
 					return nil, err
 				}
 
+				// Get hash of the optimized file, since that's what gets stored
+				f.ProcessedHash, err = hashFile(fmt.Sprint(ingestDir, "/optimized"))
+				if err != nil {
+					sentry.CaptureException(err)
+					return nil, err
+				}
+
 				// Upload optimized to bucket
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					info, err = s3Clients[s3RegionOrder[0]].FPutObject(
+					info, err = objectStores[f.UploadRegion].PutFile(
 						ctx,
 						bucket,
 						hashHex,
 						fmt.Sprint(ingestDir, "/optimized"),
-						minio.PutObjectOptions{
-							ContentType: f.Mime,
-						},
+						f.Mime,
 					)
 					f.Size = info.Size
 				}()
@@ -321,14 +412,12 @@ func IngestMultipartFile(
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					info, err = s3Clients[s3RegionOrder[0]].FPutObject(
+					info, err = objectStores[f.UploadRegion].PutFile(
 						ctx,
 						bucket,
 						hashHex,
 						fmt.Sprint(ingestDir, "/original"),
-						minio.PutObjectOptions{
-							ContentType: f.Mime,
-						},
+						f.Mime,
 					)
 					f.Size = info.Size
 				}()
@@ -381,14 +470,12 @@ func IngestMultipartFile(
 					return nil, err
 				}
 			} else { // Everything else
-				info, err = s3Clients[s3RegionOrder[0]].FPutObject(
+				info, err = objectStores[f.UploadRegion].PutFile(
 					ctx,
 					bucket,
 					hashHex,
 					fmt.Sprint(ingestDir, "/original"),
-					minio.PutObjectOptions{
-						ContentType: f.Mime,
-					},
+					f.Mime,
 				)
 				if err != nil {
 					sentry.CaptureException(err)
@@ -419,6 +506,9 @@ func IngestMultipartFile(
 
 	sentry.CaptureMessage(fmt.Sprintf("Uploaded file %s with hash %s to %s region", f.Id, f.Hash, f.UploadRegion))
 
+	// Copy the new objects to the other regions
+	queueReplication()
+
 	return &f, nil
 }
 
@@ -447,6 +537,7 @@ func (f *File) GenerateThumbnail() error {
 			sentry.CaptureException(err)
 			return err
 		}
+		defer obj.Close()
 
 		dst, err := os.Create(fmt.Sprint(ingestDir, "/original"))
 		if err != nil {
@@ -529,14 +620,13 @@ func (f *File) GenerateThumbnail() error {
 	}
 
 	// Upload thumbnail
-	uploadInfo, err := s3Clients[s3RegionOrder[0]].FPutObject(
+	region := f.WriteRegion()
+	uploadInfo, err := objectStores[region].PutFile(
 		ctx,
 		f.Bucket,
 		fmt.Sprint(f.Hash, "_thumbnail"),
 		fmt.Sprint(ingestDir, "/thumbnail.", format),
-		minio.PutObjectOptions{
-			ContentType: fmt.Sprint("image/", format),
-		},
+		fmt.Sprint("image/", format),
 	)
 	if err != nil {
 		sentry.CaptureException(err)
@@ -546,57 +636,124 @@ func (f *File) GenerateThumbnail() error {
 	// Update file details
 	f.ThumbnailMime = fmt.Sprint("image/", format)
 	f.ThumbnailSize = uploadInfo.Size
+	f.ThumbnailRegions = []string{region}
 	if _, err := db.Collection("files").UpdateMany(
 		context.TODO(),
 		bson.M{"hash": f.Hash, "bucket": f.Bucket},
 		bson.M{"$set": bson.M{
-			"thumbnail_mime": f.ThumbnailMime,
-			"thumbnail_size": f.ThumbnailSize,
+			"thumbnail_mime":    f.ThumbnailMime,
+			"thumbnail_size":    f.ThumbnailSize,
+			"thumbnail_regions": f.ThumbnailRegions,
 		}},
 	); err != nil {
 		sentry.CaptureException(err)
 		return err
 	}
 
+	// Copy the thumbnail to the other regions
+	queueReplication()
+
 	return nil
 }
 
-func (f *File) GetObject(thumbnail bool) (*minio.Object, *minio.ObjectInfo, error) {
-	objName := f.Hash
-	if thumbnail && f.Bucket == "attachments" && (strings.HasPrefix(f.Mime, "image/") || strings.HasPrefix(f.Mime, "video/")) {
-		// Generate thumbnail if one doesn't exist yet
-		if f.ThumbnailMime == "" || f.ThumbnailSize == 0 {
-			if err := f.GenerateThumbnail(); err != nil {
-				return nil, nil, err
-			}
+// Get whether the file can have a thumbnail.
+func (f *File) HasThumbnail() bool {
+	return f.Bucket == "attachments" && (strings.HasPrefix(f.Mime, "image/") || strings.HasPrefix(f.Mime, "video/"))
+}
+
+// Get the key of the object (or thumbnail).
+// The thumbnail is generated if it doesn't exist yet.
+func (f *File) ObjectKey(thumbnail bool) (string, error) {
+	if !thumbnail || !f.HasThumbnail() {
+		return f.Hash, nil
+	}
+
+	// Generate thumbnail if one doesn't exist yet
+	if f.ThumbnailMime == "" || f.ThumbnailSize == 0 {
+		if err := f.GenerateThumbnail(); err != nil {
+			return "", err
 		}
+	}
 
-		objName += "_thumbnail"
+	return f.Hash + "_thumbnail", nil
+}
+
+// Get the content type of the object (or thumbnail).
+func (f *File) ContentType(thumbnail bool) string {
+	if thumbnail && f.HasThumbnail() {
+		return f.ThumbnailMime
 	}
+	return f.Mime
+}
 
-	// Get object
-	obj, err := s3Clients[s3RegionOrder[0]].GetObject(
-		ctx,
-		f.Bucket,
-		objName,
-		minio.GetObjectOptions{},
-	)
+func (f *File) GetObject(thumbnail bool) (Object, ObjectInfo, error) {
+	objName, err := f.ObjectKey(thumbnail)
 	if err != nil {
-		return nil, nil, err
+		return nil, ObjectInfo{}, err
 	}
 
-	// Get object info (used for size)
-	objInfo, err := s3Clients[s3RegionOrder[0]].StatObject(
-		ctx,
-		f.Bucket,
-		objName,
-		minio.StatObjectOptions{},
-	)
+	// Get object and object info (used for size)
+	return getObjectFromRegions(ctx, f.ReadRegions(thumbnail && f.HasThumbnail()), f.Bucket, objName)
+}
+
+// Get a temporary URL for the object (or thumbnail) from the first healthy region that holds it.
+// Returns ErrPresignUnsupported if none of the regions support presigned URLs.
+func (f *File) PresignObject(thumbnail bool, expiry time.Duration, contentDisposition string) (*url.URL, error) {
+	objName, err := f.ObjectKey(thumbnail)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	for _, region := range orderRegions(f.ReadRegions(thumbnail && f.HasThumbnail())) {
+		if presigner, ok := objectStores[region].(ObjectPresigner); ok {
+			return presigner.PresignedGetObject(ctx, f.Bucket, objName, expiry, f.ContentType(thumbnail), contentDisposition)
+		}
 	}
 
-	return obj, &objInfo, nil
+	return nil, ErrPresignUnsupported
+}
+
+// Get the expected SHA-256 hash of the stored object (or thumbnail), if it's known.
+// Only attachments that aren't images are stored as uploaded, everything else is processed first.
+// Processed files have the hash of their processed bytes stored, except for files from before it was recorded.
+func (f *File) StoredHash(thumbnail bool) string {
+	if thumbnail {
+		return ""
+	}
+	if f.ProcessedHash != "" {
+		return f.ProcessedHash
+	}
+	if f.Bucket != "attachments" || strings.HasPrefix(f.Mime, "image/") {
+		return ""
+	}
+	return f.Hash
+}
+
+// Get the region to write new objects for the file to.
+// This is the upload region, unless it's down, draining or no longer configured.
+func (f *File) WriteRegion() string {
+	if _, ok := objectStores[f.UploadRegion]; ok && !isRegionDown(f.UploadRegion) && !isRegionDraining(f.UploadRegion) {
+		return f.UploadRegion
+	}
+	return orderRegions(writeRegionOrder)[0]
+}
+
+// Get the regions to read the object (or thumbnail) from.
+// The upload region is tried first, followed by any replicas.
+func (f *File) ReadRegions(thumbnail bool) []string {
+	stored := f.StoredRegions(thumbnail)
+	regions := make([]string, 0, len(stored)+1)
+	if slices.Contains(stored, f.UploadRegion) {
+		regions = append(regions, f.UploadRegion)
+	}
+	regions = append(regions, stored...)
+
+	// Fall back to every region if none of the recorded ones are configured anymore
+	if len(orderRegions(regions)) == 0 {
+		return regionOrder
+	}
+
+	return regions
 }
 
 func (f *File) Delete() error {
@@ -608,15 +765,44 @@ func (f *File) Delete() error {
 		return err
 	}
 
-	// Clean-up objects if nothing else is referencing them
+	return f.cleanupObjects()
+}
+
+// Delete the file only if it's still unclaimed and was uploaded by the user, in case it's been claimed since it was fetched.
+// Returns ErrFileClaimed if it wasn't deleted.
+func (f *File) DeleteUnclaimed(uploader string) error {
+	// Delete database row
+	result, err := db.Collection("files").DeleteOne(
+		context.TODO(),
+		bson.M{"_id": f.Id, "uploaded_by": uploader, "claimed": false},
+	)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrFileClaimed
+	}
+
+	return f.cleanupObjects()
+}
+
+// Queue the file's objects for deletion if no other file is referencing them.
+func (f *File) cleanupObjects() error {
 	referenced, err := isFileReferenced(f.Bucket, f.Hash)
 	if err != nil {
 		return err
 	}
 	if !referenced {
-		for _, s3Client := range s3Clients {
-			go s3Client.RemoveObject(ctx, f.Bucket, f.Hash, minio.RemoveObjectOptions{})
-			go s3Client.RemoveObject(ctx, f.Bucket, f.Hash+"_thumbnail", minio.RemoveObjectOptions{})
+		for _, region := range regionOrder {
+			if err := queueObjectDeletion(region, f.Bucket, f.Hash); err != nil {
+				return err
+			}
+
+			// The thumbnail and derived objects (like image variants) all start with the hash,
+			// derived objects aren't recorded anywhere so they get listed by the deletion worker
+			if err := queueObjectPrefixDeletion(region, f.Bucket, f.Hash+"_"); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+type GCReport struct {
+	Scanned       int
+	Orphaned      int
+	OrphanedBytes int64
+}
+
+// Get the GC grace period from OBJECT_GC_GRACE, defaulting to a day.
+func gcGracePeriod() (time.Duration, error) {
+	if os.Getenv("OBJECT_GC_GRACE") == "" {
+		return 24 * time.Hour, nil
+	}
+	grace, err := time.ParseDuration(os.Getenv("OBJECT_GC_GRACE"))
+	if err != nil {
+		return 0, fmt.Errorf("OBJECT_GC_GRACE: %w", err)
+	}
+	return grace, nil
+}
+
+// Find objects that no file references, in every bucket of every region, and queue them for deletion.
+// Objects newer than the grace period are kept, since they may belong to an upload that's still being ingested.
+// In dry-run mode, orphaned objects are only logged.
+// If a lease is given, it's renewed while listing and collecting stops if it's lost.
+func collectGarbage(grace time.Duration, dryRun bool, lease *Lease) (GCReport, error) {
+	var report GCReport
+	var errs []error
+	for _, region := range regionOrder {
+		for _, bucket := range buckets {
+			// Derived objects (like thumbnails) are keyed by the hash followed by an underscore,
+			// so each hash only needs to be looked up once
+			referenced := make(map[string]bool)
+			err := objectStores[region].ListObjects(ctx, bucket, "", func(info ObjectInfo) error {
+				if lease != nil {
+					if err := lease.Check(); err != nil {
+						return err
+					}
+				}
+
+				report.Scanned++
+				if time.Since(info.LastModified) < grace {
+					return nil
+				}
+
+				hash, _, _ := strings.Cut(info.Key, "_")
+				if _, ok := referenced[hash]; !ok {
+					var err error
+					referenced[hash], err = isFileReferenced(bucket, hash)
+					if err != nil {
+						return err
+					}
+				}
+				if referenced[hash] {
+					return nil
+				}
+
+				report.Orphaned++
+				report.OrphanedBytes += info.Size
+				if dryRun {
+					log.Printf("Orphaned object %s/%s in %s region (%d bytes, last modified %s)\n", bucket, info.Key, region, info.Size, info.LastModified.Format(time.RFC3339))
+					return nil
+				}
+				return queueObjectDeletion(region, bucket, info.Key)
+			})
+			if errors.Is(err, ErrLeaseLost) {
+				return report, err
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("collecting garbage in %s bucket of %s region: %w", bucket, region, err))
+			}
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// Collect garbage every interval.
+// Only the instance that gets the lease collects, which isn't released so the listing runs once per interval.
+func gcWorker(interval, grace time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		lease, err := AcquireLease("gc_lease", interval)
+		if err != nil {
+			log.Println(err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if lease == nil {
+			continue
+		}
+
+		report, err := collectGarbage(grace, false, lease)
+		if err != nil {
+			log.Println(err)
+			sentry.CaptureException(err)
+		}
+		log.Printf("Queued %d orphaned objects (%d bytes) out of %d for deletion\n", report.Orphaned, report.OrphanedBytes, report.Scanned)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// How long each dependency gets to respond to a readiness check
+var healthCheckTimeout = 5 * time.Second
+
+// Free space INGEST_DIR needs for the instance to be ready, in bytes
+var ingestDirMinFree int64
+
+// A dependency checked by the readiness endpoint.
+// The instance isn't ready if a critical dependency fails, or if every storage region fails.
+type healthCheck struct {
+	name     string
+	critical bool
+	region   bool
+	check    func(ctx context.Context) error
+}
+
+// How long readiness results are reused for, so probes (or anyone else, it's public) can't run the checks constantly
+const readinessCacheTTL = 5 * time.Second
+
+// Latest readiness results, the lock is held while checking so concurrent requests share the results
+var readinessCache struct {
+	sync.Mutex
+	checkedAt  time.Time
+	statusCode int
+	encoded    []byte
+}
+
+// Load the readiness check config from HEALTH_CHECK_TIMEOUT and INGEST_DIR_MIN_FREE_MIB.
+// INGEST_DIR needs room for the largest upload by default.
+func loadHealthConfig() error {
+	if os.Getenv("HEALTH_CHECK_TIMEOUT") != "" {
+		timeout, err := time.ParseDuration(os.Getenv("HEALTH_CHECK_TIMEOUT"))
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("HEALTH_CHECK_TIMEOUT must be a positive duration, got %q", os.Getenv("HEALTH_CHECK_TIMEOUT"))
+		}
+		healthCheckTimeout = timeout
+	}
+
+	if os.Getenv("INGEST_DIR_MIN_FREE_MIB") != "" {
+		minFreeMib, err := strconv.ParseInt(os.Getenv("INGEST_DIR_MIN_FREE_MIB"), 10, 32)
+		if err != nil || minFreeMib < 0 {
+			return fmt.Errorf("INGEST_DIR_MIN_FREE_MIB must be a number of MiB, got %q", os.Getenv("INGEST_DIR_MIN_FREE_MIB"))
+		}
+		ingestDirMinFree = minFreeMib << 20
+	} else {
+		for _, limits := range bucketLimits {
+			ingestDirMinFree = max(ingestDirMinFree, limits.MaxSize)
+		}
+	}
+
+	return nil
+}
+
+// Get the dependencies to check for readiness.
+func getHealthChecks() []healthCheck {
+	checks := []healthCheck{
+		{name: "mongo", critical: true, check: func(ctx context.Context) error {
+			return db.Client().Ping(ctx, nil)
+		}},
+		{name: "redis", critical: true, check: func(ctx context.Context) error {
+			return rdb.Ping(ctx).Err()
+		}},
+		{name: "ingest_dir", critical: true, check: checkIngestDir},
+	}
+
+	// Storage regions, reads and uploads skip regions that are down
+	for _, region := range regionOrder {
+		store := objectStores[region]
+		checks = append(checks, healthCheck{name: "region:" + region, region: true, check: store.Ping})
+	}
+
+	// Tools used to process uploads
+	for _, command := range []struct {
+		name string
+		arg  string
+	}{{"magick", "-version"}, {"ffmpeg", "-version"}, {"file", "--version"}} {
+		command := command
+		checks = append(checks, healthCheck{name: command.name, critical: true, check: func(ctx context.Context) error {
+			return exec.CommandContext(ctx, command.name, command.arg).Run()
+		}})
+	}
+
+	return checks
+}
+
+// Make sure INGEST_DIR exists and has enough free space for uploads.
+func checkIngestDir(ctx context.Context) error {
+	info, err := os.Stat(os.Getenv("INGEST_DIR"))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+
+	free, err := diskFreeSpace(os.Getenv("INGEST_DIR"))
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < uint64(ingestDirMinFree) {
+		return fmt.Errorf("%d MiB free, at least %d MiB is needed", free>>20, ingestDirMinFree>>20)
+	}
+
+	return nil
+}
+
+// Liveness check, which only makes sure the server is responding.
+// Dependencies aren't checked, so an outage doesn't get every instance restarted.
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, map[string]string{"status": "ok"})
+}
+
+// Readiness check, which checks every dependency at once and reports whether each one is ok.
+// Responds with 503 if the instance can't serve requests. Errors are only logged, since they can include internal addresses.
+func getReadiness(w http.ResponseWriter, r *http.Request) {
+	readinessCache.Lock()
+	defer readinessCache.Unlock()
+
+	if time.Since(readinessCache.checkedAt) >= readinessCacheTTL {
+		statusCode, encoded, err := checkReadiness()
+		if err != nil {
+			sentry.CaptureException(err)
+			http.Error(w, "Failed to send readiness", http.StatusInternalServerError)
+			return
+		}
+		readinessCache.checkedAt = time.Now()
+		readinessCache.statusCode = statusCode
+		readinessCache.encoded = encoded
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(readinessCache.statusCode)
+	w.Write(readinessCache.encoded)
+}
+
+// Run every readiness check, returns the status code and encoded body to respond with.
+func checkReadiness() (int, []byte, error) {
+	checks := getHealthChecks()
+
+	// Run checks
+	statuses := make(map[string]string, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+			defer cancel()
+			status := "ok"
+			if err := c.check(ctx); err != nil {
+				log.Printf("Readiness check for %s failed: %s\n", c.name, err)
+				status = "error"
+			}
+
+			mu.Lock()
+			statuses[c.name] = status
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	// Get overall status
+	ready := true
+	regionsUp := 0
+	for _, c := range checks {
+		if statuses[c.name] == "ok" {
+			if c.region {
+				regionsUp++
+			}
+		} else if c.critical {
+			ready = false
+		}
+	}
+	if regionsUp == 0 {
+		ready = false
+	}
+
+	status := "ok"
+	statusCode := http.StatusOK
+	if !ready {
+		status = "unavailable"
+		statusCode = http.StatusServiceUnavailable
+	} else if regionsUp < len(regionOrder) {
+		status = "degraded"
+	}
+
+	encoded, err := json.Marshal(map[string]any{
+		"status": status,
+		"checks": statuses,
+	})
+	return statusCode, encoded, err
+}
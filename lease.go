@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrLeaseLost = errors.New("lease lost")
+
+// Only extend or release a lease if it's still held with the same token
+var (
+	renewLeaseScript   = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`)
+	releaseLeaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+)
+
+// A lease in Redis that lets one instance at a time run a job.
+// It expires after the TTL unless it's renewed, so a crashed instance doesn't hold it forever.
+type Lease struct {
+	Key       string
+	Token     string
+	TTL       time.Duration
+	RenewedAt time.Time
+}
+
+// Try to acquire a lease, returns nil if another instance holds it.
+func AcquireLease(key string, ttl time.Duration) (*Lease, error) {
+	token, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	acquired, err := rdb.SetNX(context.TODO(), key, token, ttl).Result()
+	if err != nil || !acquired {
+		return nil, err
+	}
+	return &Lease{Key: key, Token: token, TTL: ttl, RenewedAt: time.Now()}, nil
+}
+
+// Extend the lease once half of its TTL has passed.
+// Returns false if it has been lost, e.g. because it expired and another instance acquired it.
+// Use Check instead to get an error when it's been lost.
+func (l *Lease) Renew() (bool, error) {
+	if time.Since(l.RenewedAt) < l.TTL/2 {
+		return true, nil
+	}
+
+	renewed, err := renewLeaseScript.Run(context.TODO(), rdb, []string{l.Key}, l.Token, l.TTL.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	l.RenewedAt = time.Now()
+	return renewed == 1, nil
+}
+
+// Extend the lease, returns ErrLeaseLost if it has been lost.
+func (l *Lease) Check() error {
+	held, err := l.Renew()
+	if err != nil {
+		return err
+	}
+	if !held {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (l *Lease) Release() error {
+	return releaseLeaseScript.Run(context.TODO(), rdb, []string{l.Key}, l.Token).Err()
+}
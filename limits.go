@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Room left in upload request bodies for the rest of the multipart form
+const maxFormOverhead = 1 << 20
+
+type BucketLimits struct {
+	MaxSize int64 // bytes
+}
+
+var bucketLimits = make(map[string]BucketLimits)
+
+// Returned when a file is larger than its bucket's maximum size.
+// It matches ErrFileTooLarge with errors.Is.
+type FileTooLargeError struct {
+	MaxSize int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file too large, the maximum size is %d MiB", e.MaxSize>>20)
+}
+
+func (e *FileTooLargeError) Is(target error) bool {
+	return target == ErrFileTooLarge
+}
+
+// Load the limits for each bucket from MAX_*_SIZE_MIB.
+// Every limit has to be set to a positive number of MiB.
+func loadBucketLimits() error {
+	for _, limit := range []struct {
+		bucket string
+		env    string
+	}{
+		{"icons", "MAX_ICON_SIZE_MIB"},
+		{"emojis", "MAX_EMOJI_SIZE_MIB"},
+		{"stickers", "MAX_STICKER_SIZE_MIB"},
+		{"attachments", "MAX_ATTACHMENT_SIZE_MIB"},
+	} {
+		maxSizeMib, err := strconv.ParseInt(os.Getenv(limit.env), 10, 32)
+		if err != nil || maxSizeMib <= 0 {
+			return fmt.Errorf("%s must be a positive number of MiB, got %q", limit.env, os.Getenv(limit.env))
+		}
+		bucketLimits[limit.bucket] = BucketLimits{MaxSize: maxSizeMib << 20}
+	}
+	return nil
+}
+
+// Get the maximum upload size for a bucket in bytes.
+func getMaxUploadSize(bucket string) int64 {
+	return bucketLimits[bucket].MaxSize
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"crypto/tls"
@@ -24,10 +26,19 @@ import (
 )
 
 var ctx context.Context = context.Background()
+var instanceId string
 var db *mongo.Database
 var rdb *redis.Client
-var s3Clients = make(map[string]*minio.Client)
-var s3RegionOrder = []string{}
+var objectStores = make(map[string]ObjectStore)
+var regionOrder = []string{}
+var buckets = []string{"icons", "emojis", "stickers", "attachments"}
+var presignedDownloadBuckets []string
+var presignedURLExpiry = 15 * time.Minute
+var presignedUploadExpiry = time.Hour
+var stagingBucket = "staging"
+var stagingExpiryDays int
+var batchUploadMaxFiles = 10
+var batchUploadWorkers = 4
 
 func main() {
 	var err error
@@ -40,6 +51,15 @@ func main() {
 		Dsn: os.Getenv("SENTRY_DSN"),
 	})
 
+	// Get instance ID, which tells instances apart for state kept in the ingest directory
+	instanceId = os.Getenv("INSTANCE_ID")
+	if instanceId == "" {
+		instanceId, err = os.Hostname()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	// Connect to MongoDB
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
 	mongoOpts := options.Client().ApplyURI(os.Getenv("MONGO_URI")).SetServerAPIOptions(serverAPI)
@@ -71,7 +91,7 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	// Connect to MinIO regions
+	// Connect to storage regions
 	var s3Endpoints [][2]string
 	err = json.Unmarshal([]byte(os.Getenv("MINIO_REGIONS")), &s3Endpoints)
 	if err != nil {
@@ -80,6 +100,17 @@ func main() {
 	for _, region := range s3Endpoints {
 		name := region[0]
 		endpoint := region[1]
+
+		// Local filesystem region (e.g. "file://./.objects")
+		if root, ok := strings.CutPrefix(endpoint, "file://"); ok {
+			objectStores[name], err = newFSStore(root)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			regionOrder = append(regionOrder, name)
+			continue
+		}
+
 		opts := &minio.Options{
 			Creds:  credentials.NewStaticV4(os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY"), ""),
 			Secure: os.Getenv("MINIO_SECURE") == "1",
@@ -97,11 +128,106 @@ func main() {
 				},
 			}
 		}
-		s3Clients[name], err = minio.New(endpoint, opts)
+		minioClient, err := minio.New(endpoint, opts)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		objectStores[name] = newMinioStore(minioClient)
+		regionOrder = append(regionOrder, name)
+	}
+
+	// Load draining regions
+	if err := loadDrainRegionConfig(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Load bucket limits
+	if err := loadBucketLimits(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Load upload region selection config
+	if err := loadUploadRegionConfig(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Load image variant config
+	if err := loadImageVariantConfig(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Load presigned download config
+	if os.Getenv("PRESIGNED_DOWNLOAD_BUCKETS") != "" {
+		presignedDownloadBuckets = strings.Split(os.Getenv("PRESIGNED_DOWNLOAD_BUCKETS"), ",")
+	}
+	if os.Getenv("PRESIGNED_URL_EXPIRY") != "" {
+		presignedURLExpiry, err = time.ParseDuration(os.Getenv("PRESIGNED_URL_EXPIRY"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Load presigned upload config
+	if os.Getenv("PRESIGNED_UPLOAD_EXPIRY") != "" {
+		presignedUploadExpiry, err = time.ParseDuration(os.Getenv("PRESIGNED_UPLOAD_EXPIRY"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if os.Getenv("STAGING_BUCKET") != "" {
+		stagingBucket = os.Getenv("STAGING_BUCKET")
+	}
+
+	// Load batch upload config
+	if os.Getenv("BATCH_UPLOAD_MAX_FILES") != "" {
+		batchUploadMaxFiles, err = strconv.Atoi(os.Getenv("BATCH_UPLOAD_MAX_FILES"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if batchUploadMaxFiles < 1 {
+			log.Fatalln("BATCH_UPLOAD_MAX_FILES must be at least 1")
+		}
+	}
+	if os.Getenv("BATCH_UPLOAD_WORKERS") != "" {
+		batchUploadWorkers, err = strconv.Atoi(os.Getenv("BATCH_UPLOAD_WORKERS"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if batchUploadWorkers < 1 {
+			log.Fatalln("BATCH_UPLOAD_WORKERS must be at least 1")
+		}
+	}
+
+	// Load tus upload config
+	if os.Getenv("TUS_UPLOAD_EXPIRY") != "" {
+		tusUploadExpiry, err = time.ParseDuration(os.Getenv("TUS_UPLOAD_EXPIRY"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Load health check config
+	if err := loadHealthConfig(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Create buckets
+	if os.Getenv("STAGING_EXPIRY_DAYS") != "" {
+		stagingExpiryDays, err = strconv.Atoi(os.Getenv("STAGING_EXPIRY_DAYS"))
 		if err != nil {
 			log.Fatalln(err)
 		}
-		s3RegionOrder = append(s3RegionOrder, name)
+	}
+	if err := provisionBuckets(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Run admin command instead of the server, if one was given
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
 
 	// Files cleanup
@@ -111,20 +237,46 @@ func main() {
 			if err := cleanupFiles(); err != nil {
 				sentry.CaptureException(err)
 			}
+			if err := cleanupTusUploads(); err != nil {
+				sentry.CaptureException(err)
+			}
 		}
 	}()
 
+	// Replicate objects to other regions
+	if len(regionOrder) > 1 {
+		go replicationWorker()
+	}
+
+	// Scrub stored objects
+	if os.Getenv("SCRUB_RATE_MIB") != "" {
+		scrubRateMib, err := strconv.ParseInt(os.Getenv("SCRUB_RATE_MIB"), 10, 64)
+		if err != nil || scrubRateMib < 0 {
+			log.Fatalln("SCRUB_RATE_MIB must be a non-negative number of MiB")
+		}
+		if scrubRateMib > 0 {
+			go scrubWorker(scrubRateMib << 20)
+		}
+	}
+
+	// Process queued object deletions
+	go deletionWorker()
+
+	// Orphaned objects cleanup
+	if os.Getenv("OBJECT_GC_INTERVAL") != "" {
+		interval, err := time.ParseDuration(os.Getenv("OBJECT_GC_INTERVAL"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		grace, err := gcGracePeriod()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go gcWorker(interval, grace)
+	}
+
 	// Create HTTP router
-	r := chi.NewRouter()
-	r.Use(cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
-	}).Handler)
-	r.Post("/{bucket:icons|emojis|stickers|attachments}", uploadFile)
-	r.Get("/{bucket:icons|emojis|stickers|attachments}/{id}", downloadFile)
-	r.Get("/{bucket:icons|emojis|stickers|attachments}/{id}/*", downloadFile)
+	r := newRouter()
 
 	// Send Sentry message
 	sentry.CaptureMessage("Starting uploads service")
@@ -140,3 +292,76 @@ func main() {
 	// Wait for Sentry events to flush
 	sentry.Flush(time.Second * 5)
 }
+
+// Create the HTTP router, with the API routes at the root and under /v1.
+func newRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(requestId)
+	r.Use(cors.New(cors.Options{
+		AllowedOrigins:   []string{"*"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"*"},
+		AllowCredentials: true,
+		ExposedHeaders: []string{
+			"Location",
+			"Upload-Offset",
+			"Upload-Length",
+			"Upload-Expires",
+			"Tus-Resumable",
+			"Tus-Version",
+			"Tus-Extension",
+			"Tus-Max-Size",
+			"X-File-Id",
+			"X-Request-Id",
+		},
+	}).Handler)
+	r.Get("/openapi.json", getOpenAPISpec)
+	r.Get("/healthz", getHealth)
+	r.Get("/readyz", getReadiness)
+	addRoutes(r)
+
+	// Versioned API, which sends errors as JSON
+	r.Route("/v1", func(r chi.Router) {
+		r.Use(jsonErrors)
+		r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+			sendError(w, r, notFoundError)
+		})
+		r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+			sendError(w, r, methodNotAllowedError)
+		})
+		addRoutes(r)
+	})
+
+	return r
+}
+
+// Add the API routes to a router.
+func addRoutes(r chi.Router) {
+	r.Post("/{bucket:icons|emojis|stickers|attachments}", uploadFile)
+	r.Post("/{bucket:icons|emojis|stickers|attachments}/batch", uploadFiles)
+	r.Route("/{bucket:icons|emojis|stickers|attachments}/tus", func(r chi.Router) {
+		r.Use(tusHeaders)
+		r.Options("/", getTusOptions)
+		r.Post("/", createTusUpload)
+		r.Head("/{id}", getTusUpload)
+		r.Patch("/{id}", patchTusUpload)
+		r.Delete("/{id}", deleteTusUpload)
+	})
+	r.Post("/{bucket:icons|emojis|stickers|attachments}/uploads", createUploadSlot)
+	r.Post("/{bucket:icons|emojis|stickers|attachments}/uploads/{id}/finalize", finalizeUploadSlot)
+	r.Get("/{bucket:icons|emojis|stickers|attachments}/{id}.json", getFileInfo)
+	r.Get("/{bucket:icons|emojis|stickers|attachments}/{id}", downloadFile)
+	r.Head("/{bucket:icons|emojis|stickers|attachments}/{id}", downloadFile)
+	r.Delete("/{bucket:icons|emojis|stickers|attachments}/{id}", deleteFile)
+	r.Get("/{bucket:icons|emojis|stickers|attachments}/{id}/*", downloadFile)
+	r.Head("/{bucket:icons|emojis|stickers|attachments}/{id}/*", downloadFile)
+
+	// Internal API for the main Meower server
+	if os.Getenv("INTERNAL_TOKEN") != "" {
+		r.Route("/internal", func(r chi.Router) {
+			r.Use(requireInternalToken)
+			r.Post("/files/claim", claimFiles)
+			r.Post("/files/unclaim", unclaimFiles)
+		})
+	}
+}
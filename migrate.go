@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+
+	"github.com/getsentry/sentry-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Move objects for a bucket (or set of files) from one region to another.
+// Each copy is verified before the file details are updated and the source objects are queued for deletion.
+func migrateRegion(from, to, bucket string, ids []string) error {
+	if from == to {
+		return errors.New("source and destination regions are the same")
+	}
+	for _, region := range []string{from, to} {
+		if _, ok := objectStores[region]; !ok {
+			return fmt.Errorf("unknown region %s", region)
+		}
+	}
+	if isRegionDraining(to) {
+		return fmt.Errorf("%s region is draining", to)
+	}
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"upload_region": from},
+		bson.M{"regions": from},
+		bson.M{"thumbnail_regions": from},
+	}}
+	if bucket != "" {
+		filter["bucket"] = bucket
+	}
+	if len(ids) > 0 {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	cur, err := db.Collection("files").Find(context.TODO(), filter)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+
+	// Multiple files can share the same objects, so only migrate each hash once
+	var migrated, failed int
+	done := make(map[string]bool)
+	for cur.Next(context.TODO()) {
+		var f File
+		if err := cur.Decode(&f); err != nil {
+			return err
+		}
+
+		if done[f.Bucket+"/"+f.Hash] {
+			continue
+		}
+		done[f.Bucket+"/"+f.Hash] = true
+
+		if err := f.MigrateRegion(from, to); err != nil {
+			log.Println(err)
+			sentry.CaptureException(err)
+			failed++
+			continue
+		}
+		migrated++
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Migrated %d objects from %s region to %s region, %d failed\n", migrated, from, to, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to migrate %d objects", failed)
+	}
+
+	return nil
+}
+
+// Move the file's object and thumbnail from one region to another.
+// Every file sharing the objects is updated to point at the new region.
+func (f *File) MigrateRegion(from, to string) error {
+	moveObject := slices.Contains(f.StoredRegions(false), from)
+	moveThumbnail := f.ThumbnailMime != "" && slices.Contains(f.StoredRegions(true), from)
+
+	// Copy and verify objects
+	if moveObject {
+		if err := migrateObject(from, to, f.Bucket, f.Hash, f.Mime, f.StoredHash(false)); err != nil {
+			return err
+		}
+	}
+	if moveThumbnail {
+		if err := migrateObject(from, to, f.Bucket, f.Hash+"_thumbnail", f.ThumbnailMime, f.StoredHash(true)); err != nil {
+			return err
+		}
+	}
+
+	// Update file details
+	filter := bson.M{"hash": f.Hash, "bucket": f.Bucket}
+	added := bson.M{}
+	if moveObject {
+		added["regions"] = to
+	}
+	if moveThumbnail {
+		added["thumbnail_regions"] = to
+	}
+	if len(added) > 0 {
+		if _, err := db.Collection("files").UpdateMany(
+			context.TODO(),
+			filter,
+			bson.M{"$addToSet": added},
+		); err != nil {
+			return err
+		}
+	}
+	if moveObject || slices.Contains(f.StoredRegions(false), to) {
+		if _, err := db.Collection("files").UpdateMany(
+			context.TODO(),
+			bson.M{"hash": f.Hash, "bucket": f.Bucket, "upload_region": from},
+			bson.M{"$set": bson.M{"upload_region": to}},
+		); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Collection("files").UpdateMany(
+		context.TODO(),
+		filter,
+		bson.M{"$pull": bson.M{"regions": from, "thumbnail_regions": from}},
+	); err != nil {
+		return err
+	}
+
+	// Remove source objects
+	if moveObject {
+		if err := queueObjectDeletion(from, f.Bucket, f.Hash); err != nil {
+			return err
+		}
+	}
+	if moveThumbnail {
+		if err := queueObjectDeletion(from, f.Bucket, f.Hash+"_thumbnail"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy an object from one region to another and make sure the copy matches.
+// If expectedHash is set, the source object must match it too.
+func migrateObject(from, to, bucket, key, contentType, expectedHash string) error {
+	obj, info, err := objectStores[from].GetObject(ctx, bucket, key)
+	if err != nil {
+		return fmt.Errorf("getting %s/%s from %s region: %w", bucket, key, from, err)
+	}
+	defer obj.Close()
+
+	hasher := sha256.New()
+	if _, err := objectStores[to].PutObject(ctx, bucket, key, io.TeeReader(obj, hasher), info.Size, contentType); err != nil {
+		return fmt.Errorf("copying %s/%s to %s region: %w", bucket, key, to, err)
+	}
+	srcHash := hex.EncodeToString(hasher.Sum(nil))
+	if expectedHash != "" && srcHash != expectedHash {
+		return fmt.Errorf("%s/%s in %s region doesn't match its hash", bucket, key, from)
+	}
+
+	dstHash, err := hashObject(ctx, objectStores[to], bucket, key, 0)
+	if err != nil {
+		return fmt.Errorf("verifying %s/%s in %s region: %w", bucket, key, to, err)
+	}
+	if dstHash != srcHash {
+		return fmt.Errorf("%s/%s in %s region doesn't match the source object", bucket, key, to)
+	}
+
+	return nil
+}
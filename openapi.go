@@ -0,0 +1,75 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// OpenAPI document describing the API, served at /openapi.json
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Matches route parameters with a regex, e.g. "{bucket:icons|emojis}"
+var routeParamRegex = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+func getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// Make sure every route of the router is described by the OpenAPI document.
+// Paths that aren't available under /v1 have to override the document's servers, which include /v1.
+func checkOpenAPISpec(r chi.Routes) error {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return fmt.Errorf("openapi.json: %w", err)
+	}
+
+	var problems []string
+	versioned := make(map[string]bool)
+	if err := chi.Walk(r, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		path := openAPIPath(route)
+		if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+			problems = append(problems, fmt.Sprintf("doesn't describe %s %s", method, route))
+		}
+		versioned[path] = versioned[path] || strings.HasPrefix(route, "/v1/")
+		return nil
+	}); err != nil {
+		return err
+	}
+	for path, isVersioned := range versioned {
+		if _, ok := spec.Paths[path]["servers"]; !isVersioned && !ok {
+			problems = append(problems, fmt.Sprintf("doesn't override servers for %s, which isn't under /v1", path))
+		}
+	}
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return fmt.Errorf("openapi.json %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// Get the OpenAPI path of a chi route, e.g. "/v1/{bucket:icons|emojis}/{id}/*" becomes "/{bucket}/{id}/{filename}".
+// Versioned routes share their paths with the unversioned ones, the version is in the document's servers.
+func openAPIPath(route string) string {
+	route = strings.TrimPrefix(route, "/v1")
+	route = routeParamRegex.ReplaceAllString(route, "{$1}")
+	if strings.HasSuffix(route, "/*") {
+		route = strings.TrimSuffix(route, "*") + "{filename}"
+	}
+	if len(route) > 1 {
+		route = strings.TrimSuffix(route, "/")
+	}
+	return route
+}
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestOpenAPISpecDescribesRoutes(t *testing.T) {
+	// The internal routes are only added when INTERNAL_TOKEN is set
+	for _, internalToken := range []string{"", "token"} {
+		t.Setenv("INTERNAL_TOKEN", internalToken)
+		if err := checkOpenAPISpec(newRouter()); err != nil {
+			t.Errorf("INTERNAL_TOKEN=%q: %v", internalToken, err)
+		}
+	}
+}
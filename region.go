@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a region is skipped for after a failed request
+const regionCooldown = 30 * time.Second
+
+var regionHealth = struct {
+	sync.Mutex
+	downUntil map[string]time.Time
+}{downUntil: make(map[string]time.Time)}
+
+func markRegionDown(region string) {
+	regionHealth.Lock()
+	defer regionHealth.Unlock()
+	if time.Now().After(regionHealth.downUntil[region]) {
+		log.Println("Marking region", region, "as down")
+	}
+	regionHealth.downUntil[region] = time.Now().Add(regionCooldown)
+}
+
+func markRegionUp(region string) {
+	regionHealth.Lock()
+	defer regionHealth.Unlock()
+	delete(regionHealth.downUntil, region)
+}
+
+func isRegionDown(region string) bool {
+	regionHealth.Lock()
+	defer regionHealth.Unlock()
+	return time.Now().Before(regionHealth.downUntil[region])
+}
+
+// Order regions for reading.
+// Configured regions are kept in the given order, but healthy regions come before ones that are down.
+func orderRegions(regions []string) []string {
+	var healthy, down []string
+	for _, region := range regions {
+		if _, ok := objectStores[region]; !ok || slices.Contains(healthy, region) || slices.Contains(down, region) {
+			continue
+		}
+		if isRegionDown(region) {
+			down = append(down, region)
+		} else {
+			healthy = append(healthy, region)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// Get an object from the first region that has it.
+// Regions that fail for reasons other than the object not existing are marked as down.
+func getObjectFromRegions(ctx context.Context, regions []string, bucket, key string) (Object, ObjectInfo, error) {
+	err := ErrObjectNotFound
+	for _, region := range orderRegions(regions) {
+		obj, info, getErr := objectStores[region].GetObject(ctx, bucket, key)
+		if getErr == nil {
+			markRegionUp(region)
+			return obj, info, nil
+		}
+		if !errors.Is(getErr, ErrObjectNotFound) {
+			markRegionDown(region)
+			err = getErr
+		}
+	}
+	return nil, ObjectInfo{}, err
+}
+
+type uploadRegionRule struct {
+	network *net.IPNet // matches the client IP, if set
+	hint    string     // matches the edge hint header otherwise
+	region  string
+}
+
+var uploadRegionRules []uploadRegionRule
+var uploadRegionWeights map[string]int
+
+// Regions that are being drained (e.g. before being removed), which are still read from and deleted from,
+// but never written to. writeRegionOrder is every other region, in the configured order.
+var drainRegions []string
+var writeRegionOrder = []string{}
+
+// Load the draining regions from MINIO_DRAIN_REGIONS (comma-separated region names).
+// At least one region has to be left to write to.
+func loadDrainRegionConfig() error {
+	if os.Getenv("MINIO_DRAIN_REGIONS") != "" {
+		for _, region := range strings.Split(os.Getenv("MINIO_DRAIN_REGIONS"), ",") {
+			region = strings.TrimSpace(region)
+			if _, ok := objectStores[region]; !ok {
+				return fmt.Errorf("MINIO_DRAIN_REGIONS: unknown region %s", region)
+			}
+			drainRegions = append(drainRegions, region)
+		}
+	}
+
+	for _, region := range regionOrder {
+		if !isRegionDraining(region) {
+			writeRegionOrder = append(writeRegionOrder, region)
+		}
+	}
+	if len(writeRegionOrder) == 0 {
+		return errors.New("MINIO_DRAIN_REGIONS: every region is draining, there's nowhere left to upload to")
+	}
+
+	return nil
+}
+
+func isRegionDraining(region string) bool {
+	return slices.Contains(drainRegions, region)
+}
+
+// Load the upload region selection config.
+//
+// UPLOAD_REGION_MAP is a list of [match, region] pairs, where match is either
+// a CIDR that the client IP is checked against, or a value of the header named
+// by UPLOAD_REGION_HINT_HEADER (e.g. a country code set by a CDN).
+//
+// UPLOAD_REGION_WEIGHTS is an object of region weights, used to pick a random
+// region when no rule matches.
+func loadUploadRegionConfig() error {
+	if os.Getenv("UPLOAD_REGION_MAP") != "" {
+		var pairs [][2]string
+		if err := json.Unmarshal([]byte(os.Getenv("UPLOAD_REGION_MAP")), &pairs); err != nil {
+			return fmt.Errorf("UPLOAD_REGION_MAP: %w", err)
+		}
+		for _, pair := range pairs {
+			rule := uploadRegionRule{region: pair[1]}
+			if _, ok := objectStores[rule.region]; !ok {
+				return fmt.Errorf("UPLOAD_REGION_MAP: unknown region %s", rule.region)
+			}
+			if _, network, err := net.ParseCIDR(pair[0]); err == nil {
+				rule.network = network
+			} else {
+				rule.hint = pair[0]
+			}
+			uploadRegionRules = append(uploadRegionRules, rule)
+		}
+	}
+
+	if os.Getenv("UPLOAD_REGION_WEIGHTS") != "" {
+		if err := json.Unmarshal([]byte(os.Getenv("UPLOAD_REGION_WEIGHTS")), &uploadRegionWeights); err != nil {
+			return fmt.Errorf("UPLOAD_REGION_WEIGHTS: %w", err)
+		}
+		for region, weight := range uploadRegionWeights {
+			if _, ok := objectStores[region]; !ok {
+				return fmt.Errorf("UPLOAD_REGION_WEIGHTS: unknown region %s", region)
+			}
+			if weight < 0 {
+				return fmt.Errorf("UPLOAD_REGION_WEIGHTS: negative weight for region %s", region)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Pick the region to upload a file to.
+// In order of priority: the X-Upload-Region header, the region map, the region weights, then the primary region.
+// Regions that are down or draining are skipped.
+func selectUploadRegion(r *http.Request) string {
+	usable := func(region string) bool {
+		_, ok := objectStores[region]
+		return ok && !isRegionDown(region) && !isRegionDraining(region)
+	}
+
+	// Requested by the client
+	if region := r.Header.Get("X-Upload-Region"); usable(region) {
+		return region
+	}
+
+	// Mapped from the client IP or edge hint
+	ip := clientIP(r)
+	hint := ""
+	if os.Getenv("UPLOAD_REGION_HINT_HEADER") != "" {
+		hint = r.Header.Get(os.Getenv("UPLOAD_REGION_HINT_HEADER"))
+	}
+	for _, rule := range uploadRegionRules {
+		var matched bool
+		if rule.network != nil {
+			matched = ip != nil && rule.network.Contains(ip)
+		} else {
+			matched = hint != "" && strings.EqualFold(rule.hint, hint)
+		}
+		if matched && usable(rule.region) {
+			return rule.region
+		}
+	}
+
+	// Weighted random choice
+	var total int
+	for region, weight := range uploadRegionWeights {
+		if usable(region) {
+			total += weight
+		}
+	}
+	if total > 0 {
+		n := rand.Intn(total)
+		for _, region := range writeRegionOrder {
+			if !usable(region) {
+				continue
+			}
+			n -= uploadRegionWeights[region]
+			if n < 0 {
+				return region
+			}
+		}
+	}
+
+	return orderRegions(writeRegionOrder)[0]
+}
+
+// Get the client IP, taking proxy headers into account.
+// This is only used for choosing a region, which clients can pick themselves anyway.
+func clientIP(r *http.Request) net.IP {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		first, _, _ := strings.Cut(forwarded, ",")
+		return net.ParseIP(strings.TrimSpace(first))
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return net.ParseIP(realIP)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return net.ParseIP(r.RemoteAddr)
+	}
+	return net.ParseIP(host)
+}
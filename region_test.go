@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelectUploadRegion(t *testing.T) {
+	setTestRegions(t, []string{"us", "eu", "ap"}, map[string]ObjectStore{"us": newMemStore(), "eu": newMemStore(), "ap": newMemStore()})
+	t.Setenv("UPLOAD_REGION_HINT_HEADER", "CF-IPCountry")
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	prevRules, prevWeights := uploadRegionRules, uploadRegionWeights
+	t.Cleanup(func() {
+		uploadRegionRules, uploadRegionWeights = prevRules, prevWeights
+	})
+	uploadRegionRules = []uploadRegionRule{
+		{network: network, region: "ap"},
+		{hint: "DE", region: "eu"},
+	}
+	uploadRegionWeights = nil
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"primary region", "192.0.2.1:1234", nil, "us"},
+		{"requested region", "192.0.2.1:1234", map[string]string{"X-Upload-Region": "eu"}, "eu"},
+		{"unknown requested region", "192.0.2.1:1234", map[string]string{"X-Upload-Region": "mars"}, "us"},
+		{"mapped network", "10.1.2.3:1234", nil, "ap"},
+		{"mapped forwarded network", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "10.1.2.3, 192.0.2.1"}, "ap"},
+		{"mapped hint", "192.0.2.1:1234", map[string]string{"CF-IPCountry": "de"}, "eu"},
+		{"requested region beats map", "10.1.2.3:1234", map[string]string{"X-Upload-Region": "us"}, "us"},
+	} {
+		r := httptest.NewRequest("POST", "/attachments", nil)
+		r.RemoteAddr = test.remoteAddr
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		if region := selectUploadRegion(r); region != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, region, test.expected)
+		}
+	}
+
+	// Regions that are down are skipped
+	markRegionDown("ap")
+	r := httptest.NewRequest("POST", "/attachments", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	if region := selectUploadRegion(r); region != "us" {
+		t.Errorf("mapped region down: got %s, expected us", region)
+	}
+	markRegionDown("us")
+	if region := selectUploadRegion(r); region != "eu" {
+		t.Errorf("mapped and primary region down: got %s, expected eu", region)
+	}
+	markRegionUp("us")
+	markRegionUp("ap")
+
+	// Weights only pick from usable regions
+	uploadRegionRules = nil
+	uploadRegionWeights = map[string]int{"eu": 1, "ap": 1}
+	markRegionDown("ap")
+	for i := 0; i < 10; i++ {
+		if region := selectUploadRegion(httptest.NewRequest("POST", "/attachments", nil)); region != "eu" {
+			t.Fatalf("weighted with ap down: got %s, expected eu", region)
+		}
+	}
+	markRegionUp("ap")
+
+	// Draining regions are never picked
+	writeRegionOrder = []string{"eu", "ap"}
+	prevDrain := drainRegions
+	t.Cleanup(func() {
+		drainRegions = prevDrain
+	})
+	drainRegions = []string{"us"}
+	uploadRegionWeights = nil
+	r = httptest.NewRequest("POST", "/attachments", nil)
+	r.Header.Set("X-Upload-Region", "us")
+	if region := selectUploadRegion(r); region != "eu" {
+		t.Errorf("requested region draining: got %s, expected eu", region)
+	}
+}
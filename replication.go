@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Replications that have failed this many times are reported as stuck
+const stuckReplicationAttempts = 10
+
+// How long a worker can replicate for without renewing its lease
+const replicationLease = 5 * time.Minute
+
+// A bucket+hash whose objects failed to replicate, so it gets retried with backoff.
+type ReplicationFailure struct {
+	Id            string `bson:"_id"` // bucket/hash
+	Bucket        string `bson:"bucket"`
+	Hash          string `bson:"hash"`
+	Attempts      int    `bson:"attempts"`
+	LastError     string `bson:"last_error"`
+	NextAttemptAt int64  `bson:"next_attempt_at"`
+}
+
+var replicationNotify = make(chan struct{}, 1)
+
+// Wake up the replication worker.
+// Does nothing if it's already been woken up.
+func queueReplication() {
+	select {
+	case replicationNotify <- struct{}{}:
+	default:
+	}
+}
+
+// Copy objects to every region that doesn't have them yet, other than draining regions.
+// Runs every minute, or straight away when queueReplication is called.
+// Only the instance holding the replication lease replicates, the rest skip the run.
+func replicationWorker() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := replicateFiles(); err != nil {
+			log.Println(err)
+			sentry.CaptureException(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-replicationNotify:
+		}
+	}
+}
+
+func replicateFiles() error {
+	// Make sure no other instance is replicating
+	lease, err := AcquireLease("replication_lease", replicationLease)
+	if err != nil || lease == nil {
+		return err
+	}
+	defer lease.Release()
+
+	// Get failed replications, which are skipped until they're due to be retried
+	failures, err := getReplicationFailures()
+	if err != nil {
+		return err
+	}
+
+	cur, err := db.Collection("files").Find(context.TODO(), bson.M{"$or": bson.A{
+		bson.M{"regions": bson.M{"$not": bson.M{"$all": writeRegionOrder}}},
+		bson.M{
+			"thumbnail_mime":    bson.M{"$exists": true},
+			"thumbnail_regions": bson.M{"$not": bson.M{"$all": writeRegionOrder}},
+		},
+	}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+
+	// Multiple files can share the same objects, so only replicate each hash once
+	done := make(map[string]bool)
+	for cur.Next(context.TODO()) {
+		var f File
+		if err := cur.Decode(&f); err != nil {
+			return err
+		}
+
+		id := f.Bucket + "/" + f.Hash
+		if done[id] {
+			continue
+		}
+		done[id] = true
+		failure, failed := failures[id]
+		if failed && failure.NextAttemptAt > time.Now().Unix() {
+			continue
+		}
+
+		// Make sure the lease is still held
+		if err := lease.Check(); err != nil {
+			return err
+		}
+
+		if replicateErr := f.Replicate(); replicateErr != nil {
+			log.Println(replicateErr)
+			if err := failure.record(f.Bucket, f.Hash, replicateErr); err != nil {
+				return err
+			}
+		} else if failed {
+			if _, err := db.Collection("replication_failures").DeleteOne(
+				context.TODO(),
+				bson.M{"_id": id},
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	return cur.Err()
+}
+
+// Get failed replications by bucket/hash.
+func getReplicationFailures() (map[string]ReplicationFailure, error) {
+	cur, err := db.Collection("replication_failures").Find(context.TODO(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []ReplicationFailure
+	if err := cur.All(context.TODO(), &failures); err != nil {
+		return nil, err
+	}
+	failuresById := make(map[string]ReplicationFailure, len(failures))
+	for _, failure := range failures {
+		failuresById[failure.Id] = failure
+	}
+	return failuresById, nil
+}
+
+// Record another failed attempt, so it gets retried with backoff.
+func (failure ReplicationFailure) record(bucket, hash string, replicateErr error) error {
+	failure.Attempts++
+	if failure.Attempts == stuckReplicationAttempts {
+		sentry.CaptureMessage(fmt.Sprintf("Replication of %s/%s is stuck: %s", bucket, hash, replicateErr))
+	}
+	_, err := db.Collection("replication_failures").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": bucket + "/" + hash},
+		bson.M{"$set": bson.M{
+			"bucket":          bucket,
+			"hash":            hash,
+			"attempts":        failure.Attempts,
+			"last_error":      replicateErr.Error(),
+			"next_attempt_at": time.Now().Add(retryBackoff(failure.Attempts)).Unix(),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// Get the regions that hold the object (or thumbnail) for the file.
+// Files from before replication existed only have an upload region.
+func (f *File) StoredRegions(thumbnail bool) []string {
+	regions := f.Regions
+	if thumbnail {
+		regions = f.ThumbnailRegions
+	}
+	if len(regions) == 0 {
+		return []string{f.UploadRegion}
+	}
+	return regions
+}
+
+// Copy the file's object and thumbnail to every region that doesn't hold them.
+func (f *File) Replicate() error {
+	var errs []error
+
+	if err := f.replicateObject(false); err != nil {
+		errs = append(errs, err)
+	}
+	if f.ThumbnailMime != "" {
+		if err := f.replicateObject(true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (f *File) replicateObject(thumbnail bool) error {
+	key, mime, field := f.Hash, f.Mime, "regions"
+	if thumbnail {
+		key, mime, field = f.Hash+"_thumbnail", f.ThumbnailMime, "thumbnail_regions"
+	}
+
+	sources := slices.Clone(f.StoredRegions(thumbnail))
+	for _, region := range writeRegionOrder {
+		if slices.Contains(sources, region) {
+			continue
+		}
+
+		if err := copyObject(sources, region, f.Bucket, key, mime); err != nil {
+			return fmt.Errorf("replicating %s/%s to %s region: %w", f.Bucket, key, region, err)
+		}
+
+		// Record the new replica on every file with the same objects
+		sources = append(sources, region)
+		if _, err := db.Collection("files").UpdateMany(
+			context.TODO(),
+			bson.M{"hash": f.Hash, "bucket": f.Bucket},
+			bson.M{"$addToSet": bson.M{field: bson.M{"$each": sources}}},
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy an object to a region from the first source region that has it.
+func copyObject(sources []string, dst string, bucket, key, contentType string) error {
+	obj, info, err := getObjectFromRegions(ctx, sources, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	_, err = objectStores[dst].PutObject(ctx, bucket, key, obj, info.Size, contentType)
+	return err
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -20,56 +28,499 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	user, err := getUserByToken(r.Header.Get("Authorization"))
 	if err != nil {
 		sentry.CaptureException(err)
-		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		sendError(w, r, invalidTokenError)
 		return
 	}
 
+	// Limit request body to the bucket's maximum size
+	maxSize := getMaxUploadSize(chi.URLParam(r, "bucket"))
+	if r.ContentLength > maxSize+maxFormOverhead {
+		sendIngestError(w, r, &FileTooLargeError{MaxSize: maxSize})
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+maxFormOverhead)
+
 	// Get file from request body
-	file, header, err := r.FormFile("file")
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendError(w, r, invalidFormError)
+		return
+	}
+	part, err := nextFilePart(reader)
+	if err != nil {
+		sendError(w, r, invalidFormError)
+		return
+	}
+
+	// Ingest file (it's streamed straight from the request body, so the size is checked while it's read)
+	f, err := IngestMultipartFile(chi.URLParam(r, "bucket"), part, user, selectUploadRegion(r))
+	if err != nil {
+		sendIngestError(w, r, err)
+		return
+	}
+
+	// Return file details
+	sendJSON(w, f)
+}
+
+// Result for a single file in a batch upload.
+type batchUploadResult struct {
+	Filename string    `json:"filename"`
+	File     *File     `json:"file,omitempty"`
+	Error    *APIError `json:"error,omitempty"`
+}
+
+// Upload several files at once.
+// Files are ingested concurrently and the results are sent in the same order as the files.
+func uploadFiles(w http.ResponseWriter, r *http.Request) {
+	// Get authed user
+	user, err := getUserByToken(r.Header.Get("Authorization"))
+	if err != nil {
+		sentry.CaptureException(err)
+		sendError(w, r, invalidTokenError)
+		return
+	}
+
+	// Limit request body to the maximum number of files at the bucket's maximum size
+	bucket := chi.URLParam(r, "bucket")
+	maxBodySize := int64(batchUploadMaxFiles) * (getMaxUploadSize(bucket) + maxFormOverhead)
+	if r.ContentLength > maxBodySize {
+		sendError(w, r, APIError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    "too_large",
+			Message: fmt.Sprintf("Request too large, the maximum size is %d MiB", maxBodySize>>20),
+		})
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	// Get files from request body
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendError(w, r, invalidFormError)
+		return
+	}
+
+	// Ingest files, each file is received from the request body before being processed alongside the others
+	region := selectUploadRegion(r)
+	var results []*batchUploadResult
+	workers := make(chan struct{}, batchUploadWorkers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		part, err := nextFilePart(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			sendError(w, r, invalidFormError)
+			return
+		}
+		if len(results) == batchUploadMaxFiles {
+			sendError(w, r, invalidFormError.WithField("file", fmt.Sprintf("must have between 1 and %d files", batchUploadMaxFiles)))
+			return
+		}
+
+		// Receive file
+		result := &batchUploadResult{Filename: part.FileName()}
+		results = append(results, result)
+		rf, err := ReceiveFile(part, getMaxUploadSize(bucket))
+		if errors.Is(err, ErrFileTooLarge) {
+			apiErr := toAPIError(err, "Failed to ingest file")
+			result.Error = &apiErr
+			continue
+		} else if err != nil {
+			sendIngestError(w, r, err)
+			return
+		}
+
+		// Process file
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(rf *ReceivedFile, result *batchUploadResult) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			defer rf.Remove()
+
+			f, err := rf.Ingest(bucket, result.Filename, user, region)
+			if err != nil {
+				apiErr := toAPIError(err, "Failed to ingest file")
+				result.Error = &apiErr
+			} else {
+				result.File = f
+			}
+		}(rf, result)
+	}
+	if len(results) == 0 {
+		sendError(w, r, invalidFormError.WithField("file", fmt.Sprintf("must have between 1 and %d files", batchUploadMaxFiles)))
+		return
+	}
+	wg.Wait()
+
+	// Return file details
+	sendJSON(w, results)
+}
+
+func createUploadSlot(w http.ResponseWriter, r *http.Request) {
+	// Get authed user
+	user, err := getUserByToken(r.Header.Get("Authorization"))
+	if err != nil {
+		sentry.CaptureException(err)
+		sendError(w, r, invalidTokenError)
+		return
+	}
+
+	// Get file details from request body
+	var body struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendError(w, r, invalidBodyError)
+		return
+	}
+	if body.Size <= 0 {
+		sendError(w, r, invalidBodyError.WithField("size", "must be a positive integer"))
+		return
+	}
+
+	// Make sure file doesn't exceeed maximum size
+	if maxSize := getMaxUploadSize(chi.URLParam(r, "bucket")); body.Size > maxSize {
+		sendIngestError(w, r, &FileTooLargeError{MaxSize: maxSize})
+		return
+	}
+
+	// Create upload slot
+	slot, err := CreateUploadSlot(chi.URLParam(r, "bucket"), body.Filename, body.Size, user, selectUploadRegion(r))
+	if err != nil {
+		sendError(w, r, toAPIError(err, "Failed to create upload slot"))
+		return
+	}
+
+	// Return upload slot details
+	sendJSON(w, slot)
+}
+
+func finalizeUploadSlot(w http.ResponseWriter, r *http.Request) {
+	// Get authed user
+	user, err := getUserByToken(r.Header.Get("Authorization"))
 	if err != nil {
-		if err != http.ErrMissingFile {
+		sentry.CaptureException(err)
+		sendError(w, r, invalidTokenError)
+		return
+	}
+
+	// Get upload slot
+	slot, err := GetUploadSlot(chi.URLParam(r, "id"))
+	if err != nil || slot.Bucket != chi.URLParam(r, "bucket") || slot.UploadedBy != user.Username {
+		if err != nil && err != redis.Nil {
 			sentry.CaptureException(err)
 		}
-		http.Error(w, "Invalid form", http.StatusBadRequest)
+		sendError(w, r, notFoundError)
+		return
+	}
+
+	// Ingest staged file
+	f, err := slot.Finalize(user)
+	if err != nil {
+		if err == ErrObjectNotFound {
+			sendError(w, r, APIError{Status: http.StatusBadRequest, Code: "not_uploaded", Message: "File not uploaded"})
+		} else {
+			sendIngestError(w, r, err)
+		}
+		return
+	}
+
+	// Return file details
+	sendJSON(w, f)
+}
+
+// Set the tus version on tus responses, and make sure clients use a supported version.
+func tusHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			sendError(w, r, APIError{Status: http.StatusPreconditionFailed, Code: "unsupported_version", Message: "Unsupported tus version"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(getMaxUploadSize(chi.URLParam(r, "bucket")), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createTusUpload(w http.ResponseWriter, r *http.Request) {
+	// Get authed user
+	user, err := getUserByToken(r.Header.Get("Authorization"))
+	if err != nil {
+		sentry.CaptureException(err)
+		sendError(w, r, invalidTokenError)
+		return
+	}
+
+	// Get upload length
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		sendError(w, r, APIError{Status: http.StatusBadRequest, Code: "invalid_header", Message: "Invalid upload length"}.WithField("Upload-Length", "must be a non-negative integer"))
 		return
 	}
-	defer file.Close()
 
 	// Make sure file doesn't exceeed maximum size
-	maxIconSizeMib, _ := strconv.ParseInt(os.Getenv("MAX_ICON_SIZE_MIB"), 10, 32)
-	maxEmojiSizeMib, _ := strconv.ParseInt(os.Getenv("MAX_EMOJI_SIZE_MIB"), 10, 32)
-	maxStickerSizeMib, _ := strconv.ParseInt(os.Getenv("MAX_STICKER_SIZE_MIB"), 10, 32)
-	maxAttachmentSizeMib, _ := strconv.ParseInt(os.Getenv("MAX_ATTACHMENT_SIZE_MIB"), 10, 32)
-	if header.Size > map[string]int64{
-		"icons":       (maxIconSizeMib << 20),
-		"emojis":      (maxEmojiSizeMib << 20),
-		"stickers":    (maxStickerSizeMib << 20),
-		"attachments": (maxAttachmentSizeMib << 20),
-	}[chi.URLParam(r, "bucket")] {
-		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
-		return
-	}
-
-	// Ingest file
-	f, err := IngestMultipartFile(chi.URLParam(r, "bucket"), file, header, user)
-	if err != nil {
-		if err == ErrUnsupportedFile {
-			http.Error(w, "Unsupported file format", http.StatusForbidden)
-		} else if err == ErrFileBlocked {
-			http.Error(w, "File blocked", http.StatusForbidden)
+	if maxSize := getMaxUploadSize(chi.URLParam(r, "bucket")); length > maxSize {
+		sendIngestError(w, r, &FileTooLargeError{MaxSize: maxSize})
+		return
+	}
+
+	// Get filename from upload metadata
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	// Create upload
+	u, err := CreateTusUpload(chi.URLParam(r, "bucket"), filename, length, user, selectUploadRegion(r))
+	if err != nil {
+		log.Println(err)
+		sentry.CaptureException(err)
+		sendError(w, r, internalError("Failed to create upload"))
+		return
+	}
+
+	// Return upload location
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+u.Id)
+	w.Header().Set("Upload-Expires", time.Unix(u.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Get a tus upload for the request, only the uploader can access it.
+// Sends an error response and returns false if it can't be accessed.
+func getRequestTusUpload(w http.ResponseWriter, r *http.Request) (*User, *TusUpload, bool) {
+	// Get authed user
+	user, err := getUserByToken(r.Header.Get("Authorization"))
+	if err != nil {
+		sentry.CaptureException(err)
+		sendError(w, r, invalidTokenError)
+		return nil, nil, false
+	}
+
+	// Get upload
+	u, err := GetTusUpload(chi.URLParam(r, "id"))
+	if err != nil || u.Bucket != chi.URLParam(r, "bucket") || u.UploadedBy != user.Username {
+		if err != nil && err != redis.Nil {
+			sentry.CaptureException(err)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		sendError(w, r, notFoundError)
+		return nil, nil, false
+	}
+
+	return user, u, true
+}
+
+// Get how much of a tus upload has been received.
+func getTusUpload(w http.ResponseWriter, r *http.Request) {
+	_, u, ok := getRequestTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", time.Unix(u.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Write a chunk to a tus upload, the file gets ingested once every chunk has been received.
+// The ingested file's ID is sent in the X-File-Id header.
+func patchTusUpload(w http.ResponseWriter, r *http.Request) {
+	user, u, ok := getRequestTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	// Get chunk details
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		sendError(w, r, APIError{Status: http.StatusUnsupportedMediaType, Code: "invalid_content_type", Message: "Invalid content type"}.WithField("Content-Type", "must be application/offset+octet-stream"))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		sendError(w, r, APIError{Status: http.StatusBadRequest, Code: "invalid_header", Message: "Invalid upload offset"}.WithField("Upload-Offset", "must be a non-negative integer"))
+		return
+	}
+
+	// Write chunk, a slow chunk gets cut off before the upload's lock expires (clients resume from what was received)
+	http.NewResponseController(w).SetReadDeadline(time.Now().Add(tusLockTimeout / 2))
+	if err := u.WriteChunk(offset, r.Body); err != nil {
+		if err == redis.Nil {
+			sendError(w, r, notFoundError)
+		} else if err == ErrTusUploadElsewhere {
+			w.Header().Set("Retry-After", "1")
+			sendError(w, r, toAPIError(err, ""))
 		} else {
-			log.Println(err)
+			sendError(w, r, toAPIError(err, "Failed to write chunk"))
+		}
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", time.Unix(u.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+
+	// Ingest file once all of it has been received
+	if u.Offset == u.Length {
+		f, err := u.Finish(user)
+		if err != nil {
+			if err == redis.Nil {
+				sendError(w, r, notFoundError)
+			} else {
+				sendIngestError(w, r, err)
+			}
+			return
+		}
+		w.Header().Set("X-File-Id", f.Id)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteTusUpload(w http.ResponseWriter, r *http.Request) {
+	_, u, ok := getRequestTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if err := u.Delete(); err != nil {
+		sendError(w, r, toAPIError(err, "Failed to delete upload"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete a file that hasn't been claimed yet, only the uploader can do this.
+func deleteFile(w http.ResponseWriter, r *http.Request) {
+	// Get authed user
+	user, err := getUserByToken(r.Header.Get("Authorization"))
+	if err != nil {
+		sentry.CaptureException(err)
+		sendError(w, r, invalidTokenError)
+		return
+	}
+
+	// Get file
+	f, err := GetFile(chi.URLParam(r, "id"))
+	if err != nil || f.Bucket != chi.URLParam(r, "bucket") {
+		if err != nil && err != mongo.ErrNoDocuments {
 			sentry.CaptureException(err)
-			http.Error(w, "Failed to ingest file", http.StatusInternalServerError)
 		}
+		sendError(w, r, notFoundError)
 		return
 	}
 
-	// Return file details
-	encoded, err := json.Marshal(f)
+	// Make sure the user uploaded the file and it's not in use
+	if f.UploadedBy != user.Username {
+		sendError(w, r, toAPIError(ErrNotUploader, ""))
+		return
+	}
+	if f.Claimed {
+		sendError(w, r, toAPIError(ErrFileClaimed, ""))
+		return
+	}
+
+	// Delete file, as long as it hasn't been claimed since it was fetched
+	if err := f.DeleteUnclaimed(user.Username); err != nil {
+		sendError(w, r, toAPIError(err, "Failed to delete file"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Only let through requests with the internal token, for the main Meower server.
+func requireInternalToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(os.Getenv("INTERNAL_TOKEN"))) != 1 {
+			sendError(w, r, invalidTokenError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func claimFiles(w http.ResponseWriter, r *http.Request) {
+	handleClaimRequest(w, r, ClaimFiles)
+}
+
+func unclaimFiles(w http.ResponseWriter, r *http.Request) {
+	handleClaimRequest(w, r, UnclaimFiles)
+}
+
+// Claim or unclaim a batch of files for a resource.
+// Responds with the IDs that were updated and the IDs that weren't (missing, wrong bucket/uploader or attached to something else).
+func handleClaimRequest(w http.ResponseWriter, r *http.Request, fn func(bucket, uploader string, ids []string, attachment FileAttachment) ([]string, error)) {
+	// Get claim details from request body
+	var body struct {
+		Bucket     string         `json:"bucket"`
+		UploadedBy string         `json:"uploaded_by"`
+		Ids        []string       `json:"ids"`
+		AttachedTo FileAttachment `json:"attached_to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		sendError(w, r, invalidBodyError)
+		return
+	}
+	if !slices.Contains(buckets, body.Bucket) {
+		sendError(w, r, APIError{Status: http.StatusBadRequest, Code: "invalid_body", Message: "Invalid bucket"}.WithField("bucket", "must be one of "+strings.Join(buckets, ", ")))
+		return
+	}
+	if body.UploadedBy == "" {
+		sendError(w, r, APIError{Status: http.StatusBadRequest, Code: "invalid_body", Message: "Invalid uploader or file IDs"}.WithField("uploaded_by", "is required"))
+		return
+	}
+	if len(body.Ids) == 0 || len(body.Ids) > 100 {
+		sendError(w, r, APIError{Status: http.StatusBadRequest, Code: "invalid_body", Message: "Invalid uploader or file IDs"}.WithField("ids", "must have between 1 and 100 file IDs"))
+		return
+	}
+	if body.AttachedTo.Type == "" || body.AttachedTo.Id == "" {
+		sendError(w, r, APIError{Status: http.StatusBadRequest, Code: "invalid_body", Message: "Invalid attachment"}.WithField("attached_to", "must have a type and ID"))
+		return
+	}
+
+	// Update files
+	updatedIds, err := fn(body.Bucket, body.UploadedBy, body.Ids, body.AttachedTo)
+	if err != nil {
+		log.Println(err)
+		sentry.CaptureException(err)
+		sendError(w, r, internalError("Failed to update files"))
+		return
+	}
+
+	// Return which files were updated
+	failedIds := []string{}
+	for _, id := range body.Ids {
+		if !slices.Contains(updatedIds, id) {
+			failedIds = append(failedIds, id)
+		}
+	}
+	sendJSON(w, map[string][]string{
+		"ids":    updatedIds,
+		"failed": failedIds,
+	})
+}
+
+func sendIngestError(w http.ResponseWriter, r *http.Request, err error) {
+	sendError(w, r, toAPIError(err, "Failed to ingest file"))
+}
+
+func sendJSON(w http.ResponseWriter, v any) {
+	encoded, err := json.Marshal(v)
 	if err != nil {
 		sentry.CaptureException(err)
-		http.Error(w, "Failed to send file details", http.StatusInternalServerError)
+		http.Error(w, "Failed to send details", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -77,6 +528,22 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	w.Write(encoded)
 }
 
+func getFileInfo(w http.ResponseWriter, r *http.Request) {
+	// Get file
+	f, err := GetFile(chi.URLParam(r, "id"))
+	if err != nil || f.Bucket != chi.URLParam(r, "bucket") {
+		if err != nil && err != mongo.ErrNoDocuments {
+			sentry.CaptureException(err)
+		}
+		sendError(w, r, notFoundError)
+		return
+	}
+
+	// Return file details
+	sendJSON(w, f)
+}
+
+// Send a file's object. HEAD requests get the same headers without the body.
 func downloadFile(w http.ResponseWriter, r *http.Request) {
 	// Get file
 	f, err := GetFile(chi.URLParam(r, "id"))
@@ -84,56 +551,94 @@ func downloadFile(w http.ResponseWriter, r *http.Request) {
 		if err != nil && err != mongo.ErrNoDocuments {
 			sentry.CaptureException(err)
 		}
-		http.Error(w, "Not found", http.StatusNotFound)
+		sendError(w, r, notFoundError)
 		return
 	}
 
-	// Caching
+	// Caching (for clients that still have the old unquoted ETag, the rest is handled by http.ServeContent)
 	if r.Header.Get("ETag") == f.Id || r.Header.Get("If-None-Match") == f.Id {
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	// Get object
+	// Get whether to send the thumbnail
 	var thumbnail bool
 	if strings.HasPrefix(f.Mime, "image/") && (r.URL.Query().Has("thumbnail") || r.URL.Query().Has("preview")) {
 		thumbnail = true
 	} else if strings.HasPrefix(f.Mime, "video/") && r.URL.Query().Has("thumbnail") {
 		thumbnail = true
 	}
-	obj, objInfo, err := f.GetObject(thumbnail)
+
+	// Get requested image variant (or the negotiated format)
+	variant, negotiated, err := getRequestedVariant(r, &f, thumbnail)
 	if err != nil {
-		sentry.CaptureException(err)
-		http.Error(w, "Failed to get object", http.StatusInternalServerError)
+		sendError(w, r, toAPIError(err, "Failed to get object"))
 		return
 	}
-
-	// Set response headers
-	if thumbnail {
-		w.Header().Set("Content-Type", f.ThumbnailMime)
-	} else {
-		w.Header().Set("Content-Type", f.Mime)
+	if negotiated {
+		w.Header().Add("Vary", "Accept")
 	}
-	w.Header().Set("Content-Length", strconv.FormatInt(objInfo.Size, 10))
-	w.Header().Set("ETag", f.Id)
-	w.Header().Set("Cache-Control", "pbulic, max-age=31536000") // 1 year cache (files should never change)
+
+	// Get content disposition
 	filename := chi.URLParam(r, "*")
 	if filename == "" {
 		filename = f.Id
 	}
+	if variant != nil {
+		filename = strings.TrimSuffix(filename, path.Ext(filename)) + variant.Extension()
+	}
+	var contentDisposition string
 	isMedia := strings.HasPrefix(f.Mime, "image/") || strings.HasPrefix(f.Mime, "video/") || strings.HasPrefix(f.Mime, "audio/")
 	if r.URL.Query().Has("download") || !isMedia {
-		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%s`, filename))
+		contentDisposition = fmt.Sprintf(`attachment; filename=%s`, filename)
 	} else {
-		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename=%s`, filename))
+		contentDisposition = fmt.Sprintf(`inline; filename=%s`, filename)
+	}
+
+	// Redirect to a presigned URL instead of sending the object ourselves, if enabled
+	if r.URL.Query().Has("redirect") || slices.Contains(presignedDownloadBuckets, f.Bucket) {
+		var u *url.URL
+		if variant != nil {
+			u, err = f.PresignVariant(*variant, presignedURLExpiry, contentDisposition)
+		} else {
+			u, err = f.PresignObject(thumbnail, presignedURLExpiry, contentDisposition)
+		}
+		if err == nil {
+			// Only cache the redirect for as long as the URL is valid
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(presignedURLExpiry.Seconds())/2))
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		} else if err != ErrPresignUnsupported {
+			sentry.CaptureException(err)
+			sendError(w, r, internalError("Failed to get object"))
+			return
+		}
 	}
 
-	// Copy the object data into the response body
-	_, err = io.Copy(w, obj)
+	// Get object
+	var obj Object
+	contentType := f.ContentType(thumbnail)
+	etag := f.Id
+	if variant != nil {
+		obj, _, err = f.GetVariant(*variant)
+		contentType = variant.ContentType()
+		etag = f.Id + "_" + variant.Suffix()
+	} else {
+		obj, _, err = f.GetObject(thumbnail)
+	}
 	if err != nil {
 		sentry.CaptureException(err)
-		log.Println(err)
-		http.Error(w, "Failed to send object", http.StatusInternalServerError)
+		sendError(w, r, internalError("Failed to get object"))
 		return
 	}
+	defer obj.Close()
+
+	// Set response headers
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, etag))
+	w.Header().Set("Cache-Control", "pbulic, max-age=31536000") // 1 year cache (files should never change)
+	w.Header().Set("Content-Disposition", contentDisposition)
+
+	// Send the object, handling range and conditional requests
+	http.ServeContent(w, r, filename, time.Unix(f.UploadedAt, 0), obj)
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long to wait between scrubbing every object
+const scrubPassInterval = time.Hour
+
+type ScrubCursor struct {
+	Bucket     string `bson:"bucket"`
+	Hash       string `bson:"hash"`
+	FinishedAt int64  `bson:"finished_at,omitempty"` // when the last pass finished, set once the cursor is reset
+}
+
+type ScrubResult struct {
+	Bucket       string `bson:"bucket"`
+	Hash         string `bson:"hash"`
+	Key          string `bson:"key"`
+	Region       string `bson:"region"`
+	Status       string `bson:"status"` // "missing" or "mismatch"
+	ExpectedHash string `bson:"expected_hash,omitempty"`
+	ActualHash   string `bson:"actual_hash,omitempty"`
+	CheckedAt    int64  `bson:"checked_at"`
+}
+
+// Continuously re-verify stored objects, one bucket+hash at a time.
+// Progress is saved in Mongo so scrubbing carries on where it left off after a restart.
+// Only the instance holding the scrub lease scrubs, since they share the cursor. Reads are limited to bytesPerSec.
+func scrubWorker(bytesPerSec int64) {
+	for {
+		lease, err := AcquireLease("scrub_lease", scrubLeaseTTL(bytesPerSec))
+		if err != nil {
+			log.Println(err)
+			sentry.CaptureException(err)
+		}
+		if lease == nil {
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		wait := scrubWhileLeased(lease, bytesPerSec)
+		lease.Release()
+		time.Sleep(wait)
+	}
+}
+
+// Scrub until the lease is lost, scrubbing fails or every object has been scrubbed.
+// Returns how long to wait before trying to scrub again.
+func scrubWhileLeased(lease *Lease, bytesPerSec int64) time.Duration {
+	for {
+		held, err := lease.Renew()
+		if err != nil {
+			log.Println(err)
+			sentry.CaptureException(err)
+			return time.Minute
+		}
+		if !held {
+			return time.Minute
+		}
+
+		done, err := scrubNext(bytesPerSec)
+		if err != nil {
+			log.Println(err)
+			sentry.CaptureException(err)
+			return time.Minute
+		}
+		if done {
+			return scrubPassInterval
+		}
+	}
+}
+
+// Get how long the scrub lease lasts without being renewed.
+// It's renewed between files, so it has to outlast reading the largest file (and its thumbnail) from every region.
+func scrubLeaseTTL(bytesPerSec int64) time.Duration {
+	var maxSize int64
+	for _, limits := range bucketLimits {
+		maxSize = max(maxSize, limits.MaxSize)
+	}
+	readTime := time.Duration(2*int64(len(regionOrder))*maxSize/bytesPerSec) * time.Second
+	return max(5*time.Minute, 2*readTime)
+}
+
+// Scrub the objects for the next bucket+hash after the saved cursor.
+// Returns true once every object has been scrubbed and the cursor has been reset,
+// or if the last pass finished less than scrubPassInterval ago.
+func scrubNext(bytesPerSec int64) (bool, error) {
+	// Get cursor
+	var cursor ScrubCursor
+	err := db.Collection("scrub_state").FindOne(
+		context.TODO(),
+		bson.M{"_id": "cursor"},
+	).Decode(&cursor)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return false, err
+	}
+	if cursor.Bucket == "" && time.Since(time.Unix(cursor.FinishedAt, 0)) < scrubPassInterval {
+		return true, nil
+	}
+
+	// Get next file
+	var f File
+	err = db.Collection("files").FindOne(
+		context.TODO(),
+		bson.M{"$or": bson.A{
+			bson.M{"bucket": cursor.Bucket, "hash": bson.M{"$gt": cursor.Hash}},
+			bson.M{"bucket": bson.M{"$gt": cursor.Bucket}},
+		}},
+		options.FindOne().SetSort(bson.D{{Key: "bucket", Value: 1}, {Key: "hash", Value: 1}}),
+	).Decode(&f)
+	if err == mongo.ErrNoDocuments {
+		log.Println("Finished scrubbing objects")
+		cursor = ScrubCursor{FinishedAt: time.Now().Unix()}
+	} else if err != nil {
+		return false, err
+	} else {
+		if err := f.Scrub(bytesPerSec); err != nil {
+			return false, err
+		}
+		cursor = ScrubCursor{Bucket: f.Bucket, Hash: f.Hash}
+	}
+
+	// Save cursor
+	if _, err := db.Collection("scrub_state").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": "cursor"},
+		bson.M{"$set": cursor},
+		options.Update().SetUpsert(true),
+	); err != nil {
+		return false, err
+	}
+
+	return cursor.Bucket == "", nil
+}
+
+// Make sure the file's objects exist in every region they're meant to be in,
+// and that they match their hash where it's known.
+func (f *File) Scrub(bytesPerSec int64) error {
+	for _, thumbnail := range []bool{false, true} {
+		if thumbnail && f.ThumbnailMime == "" {
+			continue
+		}
+
+		key := f.Hash
+		if thumbnail {
+			key += "_thumbnail"
+		}
+
+		for _, region := range f.StoredRegions(thumbnail) {
+			store, ok := objectStores[region]
+			if !ok {
+				continue
+			}
+
+			result := ScrubResult{
+				Bucket:       f.Bucket,
+				Hash:         f.Hash,
+				Key:          key,
+				Region:       region,
+				ExpectedHash: f.StoredHash(thumbnail),
+			}
+			var err error
+			if result.ExpectedHash == "" {
+				// Nothing to compare against, so just make sure it exists
+				_, err = store.StatObject(ctx, f.Bucket, key)
+			} else {
+				result.ActualHash, err = hashObject(ctx, store, f.Bucket, key, bytesPerSec)
+				if err == nil && result.ActualHash != result.ExpectedHash {
+					result.Status = "mismatch"
+				}
+			}
+			if errors.Is(err, ErrObjectNotFound) {
+				result.Status = "missing"
+			} else if err != nil {
+				// Don't hold up scrubbing other regions if this one is having issues
+				log.Println(err)
+				sentry.CaptureException(err)
+				continue
+			}
+
+			if result.Status != "" {
+				if err := reportScrubResult(result); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func reportScrubResult(result ScrubResult) error {
+	result.CheckedAt = time.Now().Unix()
+	log.Printf("Scrub found %s object %s/%s in %s region\n", result.Status, result.Bucket, result.Key, result.Region)
+	sentry.CaptureMessage(fmt.Sprintf("Scrub found %s object %s/%s in %s region", result.Status, result.Bucket, result.Key, result.Region))
+	_, err := db.Collection("scrub_results").InsertOne(context.TODO(), &result)
+	return err
+}
+
+// throttledReader limits how fast the underlying reader is read from.
+type throttledReader struct {
+	r           io.Reader
+	bytesPerSec int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Read in small chunks so the rate stays smooth
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	n, err := t.r.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(t.bytesPerSec))
+	return n, err
+}
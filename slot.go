@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var ErrSlotSizeMismatch = errors.New("upload size mismatch")
+
+// An upload slot lets a client upload a file straight to a staging bucket
+// with a presigned URL, before it gets finalized and ingested.
+type UploadSlot struct {
+	Id         string `msgpack:"id" json:"id"`
+	Bucket     string `msgpack:"bucket" json:"-"`
+	Region     string `msgpack:"region" json:"-"`
+	Filename   string `msgpack:"filename" json:"-"`
+	Size       int64  `msgpack:"size" json:"-"`
+	UploadedBy string `msgpack:"uploaded_by" json:"-"`
+	URL        string `msgpack:"-" json:"url"`
+	ExpiresAt  int64  `msgpack:"expires_at" json:"expires_at"`
+}
+
+// Create an upload slot for a file of the given size.
+// The size is signed into the presigned URL, so storage refuses uploads of any other size.
+func CreateUploadSlot(bucket string, filename string, size int64, uploader *User, region string) (*UploadSlot, error) {
+	// Make sure the region supports presigned URLs
+	presigner, ok := objectStores[region].(ObjectPresigner)
+	if !ok {
+		return nil, ErrPresignUnsupported
+	}
+
+	// Create slot ID
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create presigned URL
+	u, err := presigner.PresignedPutObject(ctx, stagingBucket, id, size, presignedUploadExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save slot, giving the client time to finalize once the URL has expired
+	slot := UploadSlot{
+		Id:         id,
+		Bucket:     bucket,
+		Region:     region,
+		Filename:   filename,
+		Size:       size,
+		UploadedBy: uploader.Username,
+		URL:        u.String(),
+		ExpiresAt:  time.Now().Add(presignedUploadExpiry).Unix(),
+	}
+	marshaledSlot, err := msgpack.Marshal(&slot)
+	if err != nil {
+		return nil, err
+	}
+	if err := rdb.Set(context.TODO(), "upload_slot:"+id, marshaledSlot, presignedUploadExpiry+time.Hour).Err(); err != nil {
+		return nil, err
+	}
+
+	return &slot, nil
+}
+
+func GetUploadSlot(id string) (*UploadSlot, error) {
+	var slot UploadSlot
+	marshaledSlot, err := rdb.Get(context.TODO(), "upload_slot:"+id).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	err = msgpack.Unmarshal(marshaledSlot, &slot)
+	return &slot, err
+}
+
+// Ingest the file that was uploaded to the slot.
+// The slot and staged object are removed afterwards, whether ingesting succeeded or not.
+func (slot *UploadSlot) Finalize(uploader *User) (*File, error) {
+	// Get staged object
+	store := objectStores[slot.Region]
+	obj, info, err := store.GetObject(ctx, stagingBucket, slot.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	// Delete slot so it can't be finalized twice
+	deleted, err := rdb.Del(context.TODO(), "upload_slot:"+slot.Id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if deleted == 0 {
+		return nil, ErrObjectNotFound
+	}
+	defer func() {
+		if err := store.RemoveObject(ctx, stagingBucket, slot.Id); err != nil {
+			sentry.CaptureException(err)
+		}
+	}()
+
+	// Make sure staged object is the declared size and doesn't exceed maximum size
+	if info.Size != slot.Size {
+		return nil, ErrSlotSizeMismatch
+	}
+	if maxSize := getMaxUploadSize(slot.Bucket); info.Size > maxSize {
+		return nil, &FileTooLargeError{MaxSize: maxSize}
+	}
+
+	return IngestFile(slot.Bucket, obj, slot.Filename, uploader, slot.Region)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+var (
+	ErrObjectNotFound     = errors.New("object not found")
+	ErrPresignUnsupported = errors.New("presigned URLs unsupported")
+	ErrAccessDenied       = errors.New("access denied")
+)
+
+// How long each region gets to provision its buckets on startup
+const provisionTimeout = 30 * time.Second
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// An object returned by ObjectStore.GetObject.
+// It is seekable so it can be served with range requests.
+type Object interface {
+	io.ReadSeekCloser
+}
+
+// ObjectStore is a storage backend for a single region.
+// Missing objects are reported as ErrObjectNotFound.
+type ObjectStore interface {
+	// Upload a file from the local filesystem.
+	PutFile(ctx context.Context, bucket, key, filePath, contentType string) (ObjectInfo, error)
+
+	// Upload an object from a reader of a known size.
+	PutObject(ctx context.Context, bucket, key string, reader io.Reader, size int64, contentType string) (ObjectInfo, error)
+
+	// Get an object along with its size and content type.
+	GetObject(ctx context.Context, bucket, key string) (Object, ObjectInfo, error)
+
+	StatObject(ctx context.Context, bucket, key string) (ObjectInfo, error)
+
+	RemoveObject(ctx context.Context, bucket, key string) error
+
+	// Create a bucket if it doesn't exist yet.
+	EnsureBucket(ctx context.Context, bucket string) error
+
+	// List objects in a bucket with the given key prefix.
+	// Iteration stops when fn returns an error, which is passed back to the caller.
+	ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error
+
+	// Check that the store can be reached and has every bucket.
+	Ping(ctx context.Context) error
+}
+
+// ObjectPresigner is implemented by stores that can give out temporary URLs to objects.
+type ObjectPresigner interface {
+	// Get a temporary URL to download an object, served with the given headers.
+	PresignedGetObject(ctx context.Context, bucket, key string, expiry time.Duration, contentType, contentDisposition string) (*url.URL, error)
+
+	// Get a temporary URL to upload an object of exactly the given size with a PUT request.
+	PresignedPutObject(ctx context.Context, bucket, key string, size int64, expiry time.Duration) (*url.URL, error)
+}
+
+// ObjectExpirer is implemented by stores that can automatically delete old objects.
+type ObjectExpirer interface {
+	// Delete objects in a bucket once they're older than the given number of days.
+	SetBucketExpiry(ctx context.Context, bucket string, days int) error
+}
+
+// Make sure every bucket exists in every region.
+// Regions that support presigned URLs also get the staging bucket, with an expiry rule if stagingExpiryDays is set.
+// Only access denied errors are returned, since they need the config fixing. Regions that fail for any
+// other reason (e.g. being unreachable) are marked as down, so one region's outage doesn't stop startup.
+func provisionBuckets() error {
+	for _, region := range regionOrder {
+		if err := provisionRegion(region); err != nil {
+			if errors.Is(err, ErrAccessDenied) {
+				return err
+			}
+			log.Println(err)
+			sentry.CaptureException(err)
+			markRegionDown(region)
+		}
+	}
+
+	return nil
+}
+
+func provisionRegion(region string) error {
+	store := objectStores[region]
+	ctx, cancel := context.WithTimeout(ctx, provisionTimeout)
+	defer cancel()
+
+	regionBuckets := buckets
+	if _, ok := store.(ObjectPresigner); ok {
+		regionBuckets = append(slices.Clone(buckets), stagingBucket)
+	}
+	for _, bucket := range regionBuckets {
+		if err := store.EnsureBucket(ctx, bucket); err != nil {
+			return fmt.Errorf("provisioning %s bucket in %s region: %w", bucket, region, err)
+		}
+	}
+
+	if _, ok := store.(ObjectPresigner); ok && stagingExpiryDays > 0 {
+		if expirer, ok := store.(ObjectExpirer); ok {
+			if err := expirer.SetBucketExpiry(ctx, stagingBucket, stagingExpiryDays); err != nil {
+				return fmt.Errorf("setting expiry for %s bucket in %s region: %w", stagingBucket, region, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Get the hex-encoded SHA-256 hash of an object.
+// Reading is limited to bytesPerSec, unless it's 0.
+func hashObject(ctx context.Context, store ObjectStore, bucket, key string, bytesPerSec int64) (string, error) {
+	obj, _, err := store.GetObject(ctx, bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	var r io.Reader = obj
+	if bytesPerSec > 0 {
+		r = &throttledReader{r: obj, bytesPerSec: bytesPerSec}
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fsStore keeps objects on the local filesystem, laid out as
+// <root>/<bucket>/<first 2 characters of hash>/<key>.
+type fsStore struct {
+	root string
+}
+
+func newFSStore(root string) (*fsStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &fsStore{root: root}, nil
+}
+
+func (s *fsStore) objectPath(bucket, key string) (string, error) {
+	if len(key) < 2 || filepath.Base(key) != key || strings.HasPrefix(key, ".") {
+		return "", errors.New("invalid object key")
+	}
+	if filepath.Base(bucket) != bucket || strings.HasPrefix(bucket, ".") {
+		return "", errors.New("invalid bucket")
+	}
+	return filepath.Join(s.root, bucket, key[:2], key), nil
+}
+
+func (s *fsStore) PutFile(ctx context.Context, bucket, key, filePath, contentType string) (ObjectInfo, error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return s.PutObject(ctx, bucket, key, src, stat.Size(), contentType)
+}
+
+func (s *fsStore) PutObject(ctx context.Context, bucket, key string, reader io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	dstPath, err := s.objectPath(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// Write to a temporary file first so readers never see partial objects
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".tmp-")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, reader)
+	if err != nil {
+		tmp.Close()
+		return ObjectInfo{}, err
+	}
+	if size >= 0 && n != size {
+		tmp.Close()
+		return ObjectInfo{}, io.ErrUnexpectedEOF
+	}
+	if err := tmp.Close(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), dstPath); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return s.StatObject(ctx, bucket, key)
+}
+
+func (s *fsStore) GetObject(ctx context.Context, bucket, key string) (Object, ObjectInfo, error) {
+	objPath, err := s.objectPath(bucket, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	obj, err := os.Open(objPath)
+	if err != nil {
+		return nil, ObjectInfo{}, fsError(err)
+	}
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, fsError(err)
+	}
+
+	return obj, fsObjectInfo(key, stat), nil
+}
+
+func (s *fsStore) StatObject(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	objPath, err := s.objectPath(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	stat, err := os.Stat(objPath)
+	if err != nil {
+		return ObjectInfo{}, fsError(err)
+	}
+
+	return fsObjectInfo(key, stat), nil
+}
+
+func (s *fsStore) RemoveObject(ctx context.Context, bucket, key string) error {
+	objPath, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	// Removing an object that doesn't exist isn't an error, same as S3
+	if err := os.Remove(objPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *fsStore) EnsureBucket(ctx context.Context, bucket string) error {
+	if filepath.Base(bucket) != bucket || strings.HasPrefix(bucket, ".") {
+		return errors.New("invalid bucket")
+	}
+	return os.MkdirAll(filepath.Join(s.root, bucket), 0700)
+}
+
+func (s *fsStore) Ping(ctx context.Context) error {
+	for _, bucket := range buckets {
+		info, err := os.Stat(filepath.Join(s.root, bucket))
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return errors.New("bucket " + bucket + " isn't a directory")
+		}
+	}
+	return nil
+}
+
+func (s *fsStore) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	bucketPath := filepath.Join(s.root, bucket)
+	if _, err := os.Stat(bucketPath); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return filepath.WalkDir(bucketPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Skip shard directories that can't contain the prefix
+		if d.IsDir() {
+			if path != bucketPath && !strings.HasPrefix(prefix, d.Name()) && !strings.HasPrefix(d.Name(), prefix) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		key := d.Name()
+		if strings.HasPrefix(key, ".") || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(fsObjectInfo(key, stat))
+	})
+}
+
+func fsObjectInfo(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		LastModified: stat.ModTime(),
+	}
+}
+
+// Convert "not exist" errors to ErrObjectNotFound.
+func fsError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrObjectNotFound
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+type minioStore struct {
+	client *minio.Client
+}
+
+func newMinioStore(client *minio.Client) *minioStore {
+	return &minioStore{client: client}
+}
+
+func (s *minioStore) PutFile(ctx context.Context, bucket, key, filePath, contentType string) (ObjectInfo, error) {
+	info, err := s.client.FPutObject(
+		ctx,
+		bucket,
+		key,
+		filePath,
+		minio.PutObjectOptions{
+			ContentType: contentType,
+		},
+	)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  contentType,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+func (s *minioStore) PutObject(ctx context.Context, bucket, key string, reader io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	info, err := s.client.PutObject(
+		ctx,
+		bucket,
+		key,
+		reader,
+		size,
+		minio.PutObjectOptions{
+			ContentType: contentType,
+		},
+	)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  contentType,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+func (s *minioStore) GetObject(ctx context.Context, bucket, key string) (Object, ObjectInfo, error) {
+	obj, err := s.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, minioError(err)
+	}
+
+	// Stat the object straight away, MinIO doesn't make any requests until it's used
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, minioError(err)
+	}
+
+	return obj, toObjectInfo(info), nil
+}
+
+func (s *minioStore) StatObject(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return toObjectInfo(info), nil
+}
+
+func (s *minioStore) RemoveObject(ctx context.Context, bucket, key string) error {
+	return s.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *minioStore) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for info := range s.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return minioError(info.Err)
+		}
+		if err := fn(toObjectInfo(info)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *minioStore) EnsureBucket(ctx context.Context, bucket string) error {
+	exists, err := s.client.BucketExists(ctx, bucket)
+	if err != nil {
+		return minioPermissionError(err)
+	}
+	if exists {
+		return nil
+	}
+	return minioPermissionError(s.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}))
+}
+
+func (s *minioStore) Ping(ctx context.Context) error {
+	for _, bucket := range buckets {
+		exists, err := s.client.BucketExists(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("bucket %s doesn't exist", bucket)
+		}
+	}
+	return nil
+}
+
+func (s *minioStore) SetBucketExpiry(ctx context.Context, bucket string, days int) error {
+	config := lifecycle.NewConfiguration()
+	config.Rules = []lifecycle.Rule{{
+		ID:     "expire-staged-uploads",
+		Status: "Enabled",
+		Expiration: lifecycle.Expiration{
+			Days: lifecycle.ExpirationDays(days),
+		},
+	}}
+	return minioPermissionError(s.client.SetBucketLifecycle(ctx, bucket, config))
+}
+
+func (s *minioStore) PresignedGetObject(ctx context.Context, bucket, key string, expiry time.Duration, contentType, contentDisposition string) (*url.URL, error) {
+	reqParams := make(url.Values)
+	reqParams.Set("response-content-type", contentType)
+	reqParams.Set("response-content-disposition", contentDisposition)
+	return s.client.PresignedGetObject(ctx, bucket, key, expiry, reqParams)
+}
+
+// Content-Length is signed, so MinIO refuses uploads of any other size.
+func (s *minioStore) PresignedPutObject(ctx context.Context, bucket, key string, size int64, expiry time.Duration) (*url.URL, error) {
+	headers := make(http.Header)
+	headers.Set("Content-Length", strconv.FormatInt(size, 10))
+	return s.client.PresignHeader(ctx, http.MethodPut, bucket, key, expiry, nil, headers)
+}
+
+func toObjectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}
+}
+
+// Convert MinIO "not found" errors to ErrObjectNotFound.
+func minioError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+// Make permission errors clearer, since they're usually down to the access key's policy.
+func minioPermissionError(err error) error {
+	if err != nil && minio.ToErrorResponse(err).Code == "AccessDenied" {
+		return fmt.Errorf("%w, make sure the MinIO access key is allowed to manage buckets: %w", ErrAccessDenied, err)
+	}
+	return err
+}
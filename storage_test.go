@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory ObjectStore for tests.
+// If err is set, every request fails with it, like a region that can't be reached.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string]memObject // bucket/key
+	err     error
+}
+
+type memObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error {
+	return nil
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string]memObject)}
+}
+
+func (s *memStore) PutFile(ctx context.Context, bucket, key, filePath, contentType string) (ObjectInfo, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.PutObject(ctx, bucket, key, bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+func (s *memStore) PutObject(ctx context.Context, bucket, key string, reader io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	if s.err != nil {
+		return ObjectInfo{}, s.err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return ObjectInfo{}, io.ErrUnexpectedEOF
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := ObjectInfo{Key: key, Size: int64(len(data)), ContentType: contentType, LastModified: time.Now()}
+	s.objects[bucket+"/"+key] = memObject{data: data, info: info}
+	return info, nil
+}
+
+func (s *memStore) GetObject(ctx context.Context, bucket, key string) (Object, ObjectInfo, error) {
+	if s.err != nil {
+		return nil, ObjectInfo{}, s.err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	return memReader{bytes.NewReader(obj.data)}, obj.info, nil
+}
+
+func (s *memStore) StatObject(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	if s.err != nil {
+		return ObjectInfo{}, s.err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	return obj.info, nil
+}
+
+func (s *memStore) RemoveObject(ctx context.Context, bucket, key string) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, bucket+"/"+key)
+	return nil
+}
+
+func (s *memStore) EnsureBucket(ctx context.Context, bucket string) error {
+	return s.err
+}
+
+func (s *memStore) ListObjects(ctx context.Context, bucket, prefix string, fn func(ObjectInfo) error) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	// Copy matching objects first, so fn can modify the store
+	s.mu.Lock()
+	var infos []ObjectInfo
+	for name, obj := range s.objects {
+		if strings.HasPrefix(name, bucket+"/"+prefix) {
+			infos = append(infos, obj.info)
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(infos, func(a, b ObjectInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Ping(ctx context.Context) error {
+	return s.err
+}
+
+// Replace the configured regions for a test, restoring them (and region health) afterwards.
+// Regions are used in the given order.
+func setTestRegions(t *testing.T, order []string, stores map[string]ObjectStore) {
+	prevStores, prevOrder, prevWriteOrder := objectStores, regionOrder, writeRegionOrder
+	resetRegionHealth := func() {
+		regionHealth.Lock()
+		regionHealth.downUntil = make(map[string]time.Time)
+		regionHealth.Unlock()
+	}
+	t.Cleanup(func() {
+		objectStores, regionOrder, writeRegionOrder = prevStores, prevOrder, prevWriteOrder
+		resetRegionHealth()
+	})
+
+	objectStores = stores
+	regionOrder = order
+	writeRegionOrder = order
+	resetRegionHealth()
+}
+
+func TestFSStoreRoundTrip(t *testing.T) {
+	store, err := newFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnsureBucket(ctx, "attachments"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Put
+	data := []byte("hello world")
+	info, err := store.PutObject(ctx, "attachments", "abcdef", bytes.NewReader(data), int64(len(data)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "abcdef" || info.Size != int64(len(data)) {
+		t.Errorf("PutObject returned %+v", info)
+	}
+	if _, err := store.PutObject(ctx, "attachments", "abcdef_thumbnail", strings.NewReader("thumb"), 5, "image/webp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A size mismatch doesn't leave a partial object behind
+	if _, err := store.PutObject(ctx, "attachments", "abcxyz", strings.NewReader("short"), 10, "text/plain"); err == nil {
+		t.Error("PutObject with the wrong size succeeded")
+	}
+	if _, err := store.StatObject(ctx, "attachments", "abcxyz"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("StatObject after a failed put returned %v, expected ErrObjectNotFound", err)
+	}
+
+	// Get
+	obj, info, err := store.GetObject(ctx, "attachments", "abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || info.Size != int64(len(data)) {
+		t.Errorf("GetObject returned %q (%d bytes), expected %q", got, info.Size, data)
+	}
+
+	// List
+	var keys []string
+	if err := store.ListObjects(ctx, "attachments", "abcdef_", func(info ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, []string{"abcdef_thumbnail"}) {
+		t.Errorf("ListObjects returned %v", keys)
+	}
+
+	// Remove, which can be done twice
+	for i := 0; i < 2; i++ {
+		if err := store.RemoveObject(ctx, "attachments", "abcdef"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := store.GetObject(ctx, "attachments", "abcdef"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("GetObject after removing returned %v, expected ErrObjectNotFound", err)
+	}
+
+	// Keys can't escape the bucket
+	if _, err := store.PutObject(ctx, "attachments", "../escaped", strings.NewReader("x"), 1, "text/plain"); err == nil {
+		t.Error("PutObject with a path in the key succeeded")
+	}
+}
+
+func TestGetObjectFromRegionsFailover(t *testing.T) {
+	down := newMemStore()
+	down.err = errors.New("connection refused")
+	empty := newMemStore()
+	up := newMemStore()
+	if _, err := up.PutObject(ctx, "attachments", "abcdef", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	setTestRegions(t, []string{"down", "empty", "up"}, map[string]ObjectStore{"down": down, "empty": empty, "up": up})
+
+	// Falls back to the region that has the object, marking the failing region as down
+	obj, info, err := getObjectFromRegions(ctx, []string{"down", "empty", "up"}, "attachments", "abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+	if info.Size != 5 {
+		t.Errorf("got %d bytes, expected 5", info.Size)
+	}
+	if !isRegionDown("down") {
+		t.Error("failing region wasn't marked as down")
+	}
+	if isRegionDown("empty") {
+		t.Error("region without the object was marked as down")
+	}
+
+	// Regions that are down are tried last
+	if order := orderRegions([]string{"down", "up"}); !slices.Equal(order, []string{"up", "down"}) {
+		t.Errorf("orderRegions returned %v", order)
+	}
+
+	// The error from a failing region is returned if no region has the object
+	if _, _, err := getObjectFromRegions(ctx, []string{"down", "empty"}, "attachments", "missing"); err != down.err {
+		t.Errorf("got %v, expected %v", err, down.err)
+	}
+	if _, _, err := getObjectFromRegions(ctx, []string{"empty", "up"}, "attachments", "missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("got %v, expected ErrObjectNotFound", err)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Version of the tus resumable upload protocol that's supported
+const tusVersion = "1.0.0"
+
+// How long a chunk can hold an upload's lock
+const tusLockTimeout = 2 * time.Minute
+
+var (
+	ErrTusOffsetMismatch  = errors.New("upload offset mismatch")
+	ErrTusUploadLocked    = errors.New("upload locked")
+	ErrTusUploadElsewhere = errors.New("upload is held by another instance")
+)
+
+var tusUploadExpiry = 24 * time.Hour
+
+// A tus upload gets assembled chunk by chunk in the ingest directory,
+// then gets ingested once every chunk has been written.
+// Chunks can only be written by the instance that created the upload, unless the ingest directory is shared.
+type TusUpload struct {
+	Id         string `msgpack:"id"`
+	Instance   string `msgpack:"instance"`
+	Bucket     string `msgpack:"bucket"`
+	Region     string `msgpack:"region"`
+	Filename   string `msgpack:"filename"`
+	UploadedBy string `msgpack:"uploaded_by"`
+	Length     int64  `msgpack:"length"`
+	Offset     int64  `msgpack:"offset"`
+	ExpiresAt  int64  `msgpack:"expires_at"`
+}
+
+func CreateTusUpload(bucket string, filename string, length int64, uploader *User, region string) (*TusUpload, error) {
+	// Create upload ID
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Save upload
+	u := TusUpload{
+		Id:         id,
+		Instance:   instanceId,
+		Bucket:     bucket,
+		Region:     region,
+		Filename:   filename,
+		UploadedBy: uploader.Username,
+		Length:     length,
+		ExpiresAt:  time.Now().Add(tusUploadExpiry).Unix(),
+	}
+	if err := u.save(); err != nil {
+		return nil, err
+	}
+
+	// Create file for chunks to be written to
+	if err := os.MkdirAll(tusUploadsDir(), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(u.path())
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	return &u, nil
+}
+
+func GetTusUpload(id string) (*TusUpload, error) {
+	var u TusUpload
+	marshaledUpload, err := rdb.Get(context.TODO(), "tus_upload:"+id).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	err = msgpack.Unmarshal(marshaledUpload, &u)
+	return &u, err
+}
+
+func tusUploadsDir() string {
+	return fmt.Sprint(os.Getenv("INGEST_DIR"), "/tus")
+}
+
+func (u *TusUpload) path() string {
+	return fmt.Sprint(tusUploadsDir(), "/", u.Id)
+}
+
+func (u *TusUpload) save() error {
+	marshaledUpload, err := msgpack.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(context.TODO(), "tus_upload:"+u.Id, marshaledUpload, time.Until(time.Unix(u.ExpiresAt, 0))).Err()
+}
+
+func (u *TusUpload) lock() error {
+	locked, err := rdb.SetNX(context.TODO(), "tus_upload_lock:"+u.Id, 1, tusLockTimeout).Result()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return ErrTusUploadLocked
+	}
+	return nil
+}
+
+func (u *TusUpload) unlock() error {
+	return rdb.Del(context.TODO(), "tus_upload_lock:"+u.Id).Err()
+}
+
+// Write a chunk starting at the offset, which has to match the upload's current offset.
+// Whatever gets written is kept, even if the chunk gets cut off part way through.
+func (u *TusUpload) WriteChunk(offset int64, chunk io.Reader) error {
+	// Lock upload
+	if err := u.lock(); err != nil {
+		return err
+	}
+	defer u.unlock()
+
+	// Get current offset, now that no other chunk can change it
+	current, err := GetTusUpload(u.Id)
+	if err != nil {
+		return err
+	}
+	*u = *current
+	if offset != u.Offset {
+		return ErrTusOffsetMismatch
+	}
+
+	// Write chunk
+	file, err := os.OpenFile(u.path(), os.O_WRONLY, 0600)
+	if os.IsNotExist(err) {
+		return u.missingChunksError()
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(u.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	n, copyErr := io.Copy(file, io.LimitReader(chunk, u.Length-u.Offset))
+
+	// Save new offset
+	u.Offset += n
+	u.ExpiresAt = time.Now().Add(tusUploadExpiry).Unix()
+	if err := u.save(); err != nil {
+		return err
+	}
+
+	return copyErr
+}
+
+// Get the error for an upload whose chunks aren't in the ingest directory.
+// If another instance created the upload, the chunk can be retried until it reaches that instance.
+// Otherwise the chunks have been lost (e.g. the ingest directory was wiped), so the upload is removed.
+func (u *TusUpload) missingChunksError() error {
+	if u.Instance != instanceId {
+		return ErrTusUploadElsewhere
+	}
+	if err := rdb.Del(context.TODO(), "tus_upload:"+u.Id).Err(); err != nil {
+		return err
+	}
+	return redis.Nil
+}
+
+// Ingest the assembled file once every chunk has been written.
+// The upload is only removed once ingesting succeeds or the file gets rejected,
+// so the final chunk can be retried after an internal error.
+func (u *TusUpload) Finish(uploader *User) (*File, error) {
+	// Lock upload so it can't be finished twice at once
+	if err := u.lock(); err != nil {
+		return nil, err
+	}
+	defer u.unlock()
+
+	// Make sure the upload hasn't already been finished
+	current, err := GetTusUpload(u.Id)
+	if err != nil {
+		return nil, err
+	}
+	*u = *current
+	if u.Offset != u.Length {
+		return nil, ErrTusOffsetMismatch
+	}
+
+	// Ingest file
+	file, err := os.Open(u.path())
+	if os.IsNotExist(err) {
+		return nil, u.missingChunksError()
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f, err := IngestFile(u.Bucket, file, u.Filename, uploader, u.Region)
+	if err != nil && !errors.Is(err, ErrFileBlocked) && !errors.Is(err, ErrUnsupportedFile) && !errors.Is(err, ErrFileTooLarge) {
+		return nil, err
+	}
+
+	// Remove upload
+	if err := rdb.Del(context.TODO(), "tus_upload:"+u.Id).Err(); err != nil {
+		sentry.CaptureException(err)
+	}
+	if err := os.Remove(u.path()); err != nil {
+		sentry.CaptureException(err)
+	}
+
+	return f, err
+}
+
+// Remove the upload and its chunks.
+func (u *TusUpload) Delete() error {
+	// Lock upload, so a chunk that's being written doesn't save it again
+	if err := u.lock(); err != nil {
+		return err
+	}
+	defer u.unlock()
+
+	if err := rdb.Del(context.TODO(), "tus_upload:"+u.Id).Err(); err != nil {
+		return err
+	}
+	if err := os.Remove(u.path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Remove chunks of tus uploads that have expired.
+func cleanupTusUploads() error {
+	entries, err := os.ReadDir(tusUploadsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		// Give finished uploads time to get copied into their own ingest directory
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < time.Hour {
+			continue
+		}
+
+		exists, err := rdb.Exists(context.TODO(), "tus_upload:"+entry.Name()).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			if err := os.Remove(fmt.Sprint(tusUploadsDir(), "/", entry.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Parse tus upload metadata, e.g. "filename d29ybGQucG5n,is_confidential".
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
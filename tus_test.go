@@ -0,0 +1,22 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	for _, test := range []struct {
+		header   string
+		expected map[string]string
+	}{
+		{"filename d29ybGQucG5n", map[string]string{"filename": "world.png"}},
+		{"filename d29ybGQucG5n,is_confidential", map[string]string{"filename": "world.png", "is_confidential": ""}},
+		{" filename d29ybGQucG5n , filetype aW1hZ2UvcG5n", map[string]string{"filename": "world.png", "filetype": "image/png"}},
+		{"filename not-base64!,filetype aW1hZ2UvcG5n", map[string]string{"filetype": "image/png"}},
+	} {
+		if metadata := parseTusMetadata(test.header); !maps.Equal(metadata, test.expected) {
+			t.Errorf("parseTusMetadata(%q) = %v, expected %v", test.header, metadata, test.expected)
+		}
+	}
+}
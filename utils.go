@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"io"
+	"os"
 	"regexp"
 	"strings"
 	"time"
@@ -16,6 +20,7 @@ import (
 var (
 	ErrUnsupportedFile = errors.New("unsupported file")
 	ErrFileBlocked     = errors.New("file blocked")
+	ErrFileTooLarge    = errors.New("file too large")
 )
 
 func generateId() (string, error) {
@@ -34,6 +39,21 @@ func generateId() (string, error) {
 	return id, err
 }
 
+// Get the hex-encoded SHA-256 hash of a file.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 func cleanFilename(filename string) string {
 	re := regexp.MustCompile(`[^A-Za-z0-9\.\-\_\+\!\(\)$]`)
 	return re.ReplaceAllString(filename, "_")
@@ -55,7 +75,7 @@ func cleanupFiles() error {
 	}
 
 	for _, file := range files {
-		if err := file.Delete(); err != nil {
+		if err := file.DeleteUnclaimed(file.UploadedBy); err != nil && !errors.Is(err, ErrFileClaimed) {
 			return err
 		}
 	}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+var ErrInvalidVariant = errors.New("invalid image variant")
+
+// Sizes that requested variant dimensions get snapped up to
+var imageVariantSizes = []int{64, 128, 256, 480, 720, 1080, 1440, 1920}
+
+// Formats that variants can be converted to
+var imageVariantFormats = []string{"webp", "avif", "jpeg", "png", "gif"}
+
+// A resized and/or converted copy of an image, or a converted copy of its thumbnail.
+// Fit is one of "contain" (fit inside the size), "cover" (fill the size and crop the rest) or "fill" (stretch to the size).
+type ImageVariant struct {
+	Thumbnail bool
+	Width     int
+	Height    int
+	Fit       string
+	Format    string
+}
+
+// Load the allowed variant sizes from IMAGE_VARIANT_SIZES (comma-separated pixel sizes).
+func loadImageVariantConfig() error {
+	if os.Getenv("IMAGE_VARIANT_SIZES") == "" {
+		return nil
+	}
+
+	imageVariantSizes = nil
+	for _, s := range strings.Split(os.Getenv("IMAGE_VARIANT_SIZES"), ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || size <= 0 {
+			return fmt.Errorf("IMAGE_VARIANT_SIZES: invalid size %s", s)
+		}
+		imageVariantSizes = append(imageVariantSizes, size)
+	}
+	slices.Sort(imageVariantSizes)
+
+	return nil
+}
+
+// Get the variant of the object (or thumbnail) to send for a download request.
+// The width, height, fit and format query parameters are used for images, and if no format
+// is given, the format is negotiated from the Accept header. Downloads (?download) are never
+// negotiated, and neither are originals unless the client is asking for an image, so navigating
+// to a file or saving it gets the bytes that were uploaded.
+// Returns nil if the object should be sent as it's stored, and whether the Accept header was used.
+func getRequestedVariant(r *http.Request, f *File, thumbnail bool) (*ImageVariant, bool, error) {
+	var v *ImageVariant
+	if strings.HasPrefix(f.Mime, "image/") {
+		var err error
+		v, err = parseImageVariant(r.URL.Query(), f)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if v != nil && v.Format != "" {
+		return v, false, nil
+	}
+
+	// Get the format the image (or thumbnail) is stored in
+	thumbnail = v == nil && thumbnail && f.HasThumbnail()
+	if !thumbnail && !strings.HasPrefix(f.Mime, "image/") {
+		return nil, false, nil
+	}
+	if thumbnail {
+		// Make sure the thumbnail has been generated
+		if _, err := f.ObjectKey(true); err != nil {
+			return nil, false, err
+		}
+	}
+	stored := strings.TrimPrefix(f.ContentType(thumbnail), "image/")
+
+	// Negotiate format
+	var format string
+	negotiated := !r.URL.Query().Has("download")
+	if negotiated && (v != nil || thumbnail || isImageRequest(r.Header.Get("Accept"))) {
+		format = negotiateImageFormat(r.Header.Get("Accept"), stored)
+	}
+	if v == nil {
+		if format == "" {
+			return nil, negotiated, nil
+		}
+		v = &ImageVariant{Thumbnail: thumbnail, Fit: "contain"}
+	}
+	v.Format = format
+	if v.Format == "" {
+		v.Format = stored
+		if !slices.Contains(imageVariantFormats, v.Format) {
+			v.Format = "webp"
+		}
+	}
+
+	return v, negotiated, nil
+}
+
+// Get whether an Accept header is from a request for an image (like an <img> tag), rather than a navigation.
+// Browsers list image/* for images, and text/html when navigating.
+func isImageRequest(accept string) bool {
+	accepted := parseAccept(accept)
+	return accepted["image/*"] && !accepted["text/html"]
+}
+
+// Get the variant requested by the width, height, fit and format query parameters.
+// Returns nil if none of them were given, the format is left empty if it wasn't given.
+func parseImageVariant(query url.Values, f *File) (*ImageVariant, error) {
+	if !query.Has("width") && !query.Has("height") && !query.Has("fit") && !query.Has("format") {
+		return nil, nil
+	}
+
+	v := ImageVariant{
+		Fit:    query.Get("fit"),
+		Format: strings.ToLower(query.Get("format")),
+	}
+
+	// Get size, snapped to an allowed size
+	for _, dimension := range []struct {
+		param string
+		size  *int
+	}{{"width", &v.Width}, {"height", &v.Height}} {
+		if !query.Has(dimension.param) {
+			continue
+		}
+		size, err := strconv.Atoi(query.Get(dimension.param))
+		if err != nil || size <= 0 {
+			return nil, &FieldError{Err: ErrInvalidVariant, Field: dimension.param, Reason: "must be a positive integer"}
+		}
+		*dimension.size = snapImageVariantSize(size)
+	}
+
+	// Get fit, cropping and stretching need both dimensions
+	if v.Fit != "" && !slices.Contains([]string{"contain", "cover", "fill"}, v.Fit) {
+		return nil, &FieldError{Err: ErrInvalidVariant, Field: "fit", Reason: "must be one of contain, cover, fill"}
+	}
+	if v.Fit == "" || v.Width == 0 || v.Height == 0 {
+		v.Fit = "contain"
+	}
+
+	// Get format
+	if v.Format == "jpg" {
+		v.Format = "jpeg"
+	}
+	if v.Format != "" && !slices.Contains(imageVariantFormats, v.Format) {
+		return nil, &FieldError{Err: ErrInvalidVariant, Field: "format", Reason: "must be one of " + strings.Join(imageVariantFormats, ", ")}
+	}
+
+	return &v, nil
+}
+
+// Pick the format to send an image in from an Accept header.
+// AVIF and WebP are used when the client lists them, falling back to PNG or JPEG if the stored format isn't accepted.
+// Returns an empty string if the image should be sent in its stored format.
+func negotiateImageFormat(accept string, stored string) string {
+	// Only convert images in formats that can be converted back and forth
+	if accept == "" || !slices.Contains(imageVariantFormats, stored) {
+		return ""
+	}
+
+	// GIFs and WebPs might be animated, and AVIF variants only get the first frame
+	accepted := parseAccept(accept)
+	if stored != "gif" && stored != "webp" && accepted["image/avif"] {
+		return "avif"
+	}
+	if stored != "webp" && accepted["image/webp"] {
+		return "webp"
+	}
+
+	if accepted["image/"+stored] || accepted["image/*"] || accepted["*/*"] {
+		return ""
+	}
+	if accepted["image/png"] {
+		return "png"
+	}
+	if accepted["image/jpeg"] {
+		return "jpeg"
+	}
+	return ""
+}
+
+// Get the media types accepted by an Accept header, leaving out ones with a quality of 0.
+func parseAccept(header string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType == "" {
+			continue
+		}
+
+		refused := false
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+					refused = true
+				}
+			}
+		}
+		if !refused {
+			accepted[mediaType] = true
+		}
+	}
+	return accepted
+}
+
+// Snap a size up to the nearest allowed size, or down to the largest one.
+func snapImageVariantSize(size int) int {
+	for _, allowed := range imageVariantSizes {
+		if allowed >= size {
+			return allowed
+		}
+	}
+	return imageVariantSizes[len(imageVariantSizes)-1]
+}
+
+// Get the part of the object key (and ETag) that identifies the variant, e.g. "480x0_contain.webp" or "thumbnail.avif".
+func (v ImageVariant) Suffix() string {
+	if v.Thumbnail {
+		return "thumbnail." + v.Format
+	}
+	return fmt.Sprintf("%dx%d_%s.%s", v.Width, v.Height, v.Fit, v.Format)
+}
+
+func (v ImageVariant) ContentType() string {
+	return "image/" + v.Format
+}
+
+// Get the filename extension for the variant's format, e.g. ".webp".
+func (v ImageVariant) Extension() string {
+	if v.Format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + v.Format
+}
+
+// Get the ImageMagick arguments for resizing to the variant's size.
+func (v ImageVariant) resizeArgs() []string {
+	if v.Thumbnail || (v.Width == 0 && v.Height == 0) {
+		return nil
+	}
+
+	size := ""
+	if v.Width > 0 {
+		size += strconv.Itoa(v.Width)
+	}
+	size += "x"
+	if v.Height > 0 {
+		size += strconv.Itoa(v.Height)
+	}
+
+	switch v.Fit {
+	case "cover":
+		return []string{"-resize", size + "^", "-gravity", "center", "-extent", size}
+	case "fill":
+		return []string{"-resize", size + "!"}
+	default:
+		return []string{"-resize", size + ">"} // only shrink
+	}
+}
+
+// Get a variant of the image, it gets generated and stored the first time it's requested.
+func (f *File) GetVariant(v ImageVariant) (Object, ObjectInfo, error) {
+	key := f.Hash + "_" + v.Suffix()
+	obj, info, err := getObjectFromRegions(ctx, f.variantRegions(), f.Bucket, key)
+	if !errors.Is(err, ErrObjectNotFound) {
+		return obj, info, err
+	}
+
+	region, err := f.GenerateVariant(v)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return objectStores[region].GetObject(ctx, f.Bucket, key)
+}
+
+// Get a temporary URL for a variant of the image, generating it first if it doesn't exist yet.
+// Returns ErrPresignUnsupported if the region holding the variant doesn't support presigned URLs.
+func (f *File) PresignVariant(v ImageVariant, expiry time.Duration, contentDisposition string) (*url.URL, error) {
+	region, err := f.variantRegion(v)
+	if err != nil {
+		return nil, err
+	}
+
+	presigner, ok := objectStores[region].(ObjectPresigner)
+	if !ok {
+		return nil, ErrPresignUnsupported
+	}
+	return presigner.PresignedGetObject(ctx, f.Bucket, f.Hash+"_"+v.Suffix(), expiry, v.ContentType(), contentDisposition)
+}
+
+// Get a region that holds a variant of the image, generating it if none do.
+func (f *File) variantRegion(v ImageVariant) (string, error) {
+	for _, region := range orderRegions(f.variantRegions()) {
+		if _, err := objectStores[region].StatObject(ctx, f.Bucket, f.Hash+"_"+v.Suffix()); err == nil {
+			return region, nil
+		}
+	}
+	return f.GenerateVariant(v)
+}
+
+// Get the regions that could hold variants of the image.
+// Variants are generated in the write region, which might not hold the image yet (e.g. while its upload region is down).
+func (f *File) variantRegions() []string {
+	return append(slices.Clone(f.ReadRegions(false)), f.WriteRegion())
+}
+
+// Generate a variant of the image and store it in the file's write region.
+// Variants aren't replicated, other regions generate their own when they need them.
+// Returns the region the variant was stored in.
+func (f *File) GenerateVariant(v ImageVariant) (string, error) {
+	// Create directory in ingest directory for temporary files
+	id, err := generateId()
+	if err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+	ingestDir := fmt.Sprint(os.Getenv("INGEST_DIR"), "/", id)
+	defer os.RemoveAll(ingestDir)
+	if err := os.Mkdir(ingestDir, 0700); err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+
+	// Download image (or thumbnail)
+	obj, _, err := f.GetObject(v.Thumbnail)
+	if err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+	defer obj.Close()
+	dst, err := os.Create(fmt.Sprint(ingestDir, "/original"))
+	if err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, obj); err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+
+	// Create variant (only GIF and WebP keep animations, the rest use the first frame)
+	src := fmt.Sprint(ingestDir, "/original")
+	if v.Format != "gif" && v.Format != "webp" {
+		src += "[0]"
+	}
+	args := []string{src, "-auto-orient"}
+	args = append(args, v.resizeArgs()...)
+	args = append(args, "-strip", "-quality", "90", fmt.Sprint(ingestDir, "/variant.", v.Format))
+	if err := exec.Command("magick", args...).Run(); err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+
+	// Upload variant
+	region := f.WriteRegion()
+	if _, err := objectStores[region].PutFile(
+		ctx,
+		f.Bucket,
+		f.Hash+"_"+v.Suffix(),
+		fmt.Sprint(ingestDir, "/variant.", v.Format),
+		v.ContentType(),
+	); err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+
+	return region, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestNegotiateImageFormat(t *testing.T) {
+	for _, test := range []struct {
+		accept   string
+		stored   string
+		expected string
+	}{
+		{"", "png", ""},
+		{"image/avif,image/webp,*/*", "png", "avif"},
+		{"image/avif,image/webp,*/*", "jpeg", "avif"},
+		{"image/avif;q=0,image/webp,*/*", "png", "webp"},
+		{"image/webp,*/*", "png", "webp"},
+		{"image/webp,*/*", "webp", ""},
+		{"image/avif,image/webp,*/*", "gif", "webp"},
+		{"image/avif,image/webp,*/*", "webp", ""},
+		{"image/png", "png", ""},
+		{"image/*", "png", ""},
+		{"image/png", "webp", "png"},
+		{"image/jpeg", "webp", "jpeg"},
+		{"text/plain", "png", ""},
+		{"image/avif,image/webp,*/*", "svg+xml", ""},
+	} {
+		if format := negotiateImageFormat(test.accept, test.stored); format != test.expected {
+			t.Errorf("negotiateImageFormat(%q, %q) = %q, expected %q", test.accept, test.stored, format, test.expected)
+		}
+	}
+}
+
+func TestParseImageVariant(t *testing.T) {
+	prevSizes := imageVariantSizes
+	t.Cleanup(func() {
+		imageVariantSizes = prevSizes
+	})
+	imageVariantSizes = []int{64, 128, 256, 480}
+
+	for _, test := range []struct {
+		query    string
+		expected *ImageVariant
+	}{
+		{"", nil},
+		{"download", nil},
+		{"width=100", &ImageVariant{Width: 128, Fit: "contain"}},
+		{"width=480&height=1", &ImageVariant{Width: 480, Height: 64, Fit: "contain"}},
+		{"height=1000", &ImageVariant{Height: 480, Fit: "contain"}},
+		{"width=100&fit=cover", &ImageVariant{Width: 128, Fit: "contain"}},
+		{"width=100&height=100&fit=cover", &ImageVariant{Width: 128, Height: 128, Fit: "cover"}},
+		{"width=100&height=100&fit=fill&format=JPG", &ImageVariant{Width: 128, Height: 128, Fit: "fill", Format: "jpeg"}},
+		{"format=webp", &ImageVariant{Fit: "contain", Format: "webp"}},
+	} {
+		query, _ := url.ParseQuery(test.query)
+		v, err := parseImageVariant(query, &File{Mime: "image/png"})
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if (v == nil) != (test.expected == nil) || (v != nil && *v != *test.expected) {
+			t.Errorf("%q: got %+v, expected %+v", test.query, v, test.expected)
+		}
+	}
+
+	for _, test := range []struct {
+		query string
+		field string
+	}{
+		{"width=0", "width"},
+		{"width=abc", "width"},
+		{"height=-5", "height"},
+		{"fit=stretch", "fit"},
+		{"width=100&fit=stretch", "fit"},
+		{"format=bmp", "format"},
+	} {
+		query, _ := url.ParseQuery(test.query)
+		_, err := parseImageVariant(query, &File{Mime: "image/png"})
+		var fieldErr *FieldError
+		if !errors.Is(err, ErrInvalidVariant) || !errors.As(err, &fieldErr) || fieldErr.Field != test.field {
+			t.Errorf("%q: got %v, expected an invalid %s", test.query, err, test.field)
+		}
+	}
+}